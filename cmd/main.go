@@ -1,40 +1,131 @@
 package main
 
 import (
+	"bytes"
+	gocontext "context"
+	"crypto/sha256"
+	"crypto/subtle"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"math"
+	"math/rand"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
-	version = "development"
-	lock    = &sync.Mutex{}
+	version       = "development"
+	errGateDenied = errors.New("gate command denied turning on")
+	errPanic      = errors.New("panic file is present, not turning on")
+	errCooldown   = errors.New("actuated too recently")
+	lock          = &sync.Mutex{}
+	// actionLock makes each state changing action a single read-modify-write
+	actionLock = &sync.Mutex{}
+	// historyLock guards the history log
+	historyLock = &sync.Mutex{}
+	// logLevel is the minimum level written, set once at startup
+	logLevel  = levelInfo
+	logLevels = []string{"debug", "info", "warn", "error"}
+	// dayNames are ordered by dayIndex
+	dayNames = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+	// stateMigrations upgrade a state from the schema version at their index to the next one
+	stateMigrations = []func(*State){
+		func(s *State) {
+			// version 0 did not track which mode a running unit was started in
+			if s.Running && s.RunningMode == "" {
+				s.RunningMode = s.OpMode
+			}
+		},
+	}
+	// readActions are safe to use as the endpoint root
+	readActions  = []string{isDisplay, "current", "lastcommand", "trace", "capabilities", "downloadstate", scheduleJSON, "report", overrideStatus, "status", "metrics", "history", "healthz", "preview"}
+	writeActions = []string{onAction, offAction, "toggle", "forceoff", "calibrate", "setmode", "apply", "nextmode", "pause", "reset", "togglelock", "toggleschedule", "schedule", scheduleJSON, "scheduletable"}
+	// scheduleFeatures name the schedule syntax extensions understood by parseSchedule
+	scheduleFeatures = []string{"comments", "inline-comments", "time-ranges", "day-ranges", "day-names", "variables", "default-directive", "entry-modes", "sun-times"}
+	// labelSets are the yes/no representations selectable with the labels config
+	labelSets = map[string][2]string{
+		"":           {"YES", "NO"},
+		"yes-no":     {"YES", "NO"},
+		"true-false": {"true", "false"},
+		"1-0":        {"1", "0"},
+	}
+	sendVerbs = []string{defaultVerb, "SEND_START", "SEND_STOP", "SEND_MACRO"}
+	// alignDelay is the pause before each alignment send, long enough to see the unit react
+	alignDelay = 5 * time.Second
 	//go:embed template.html
 	templateHTML string
+	//go:embed favicon.ico
+	favicon []byte
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
 )
 
 const (
-	onAction     = "on"
-	offAction    = "off"
-	noAction     = ""
-	isDisplay    = "display"
-	endpoint     = "/wit/"
-	weekdayType  = "weekday"
-	weekendType  = "weekend"
-	commandStart = "START"
-	commandStop  = "STOP"
+	onAction          = "on"
+	offAction         = "off"
+	noAction          = ""
+	isDisplay         = "display"
+	defaultEndpoint   = "/wit/"
+	staticEndpoint    = "/static/"
+	weekdayType       = "weekday"
+	weekendType       = "weekend"
+	everydayType      = "everyday"
+	commandStart      = "START"
+	commandStop       = "STOP"
+	defaultVerb       = "SEND_ONCE"
+	lircClassic       = "classic"
+	lircTOML          = "toml"
+	maxModes          = 64
+	maxModeLength     = 32
+	logWindow         = 10 * time.Minute
+	actionTimeout     = 30 * time.Second
+	baselineNone      = "none"
+	variablePrefix    = "@"
+	defaultDirective  = "@default"
+	allDays           = "all"
+	scheduleJSON      = "schedule.json"
+	overrideStatus    = "override/status"
+	timeFormat        = "2006-01-02T15:04:05"
+	outcomeActuated   = "actuated"
+	outcomeUnchanged  = "unchanged"
+	outcomeSuppressed = "suppressed"
+	outcomeNone       = "none"
+	sunrise           = "sunrise"
+	sunset            = "sunset"
+	confirmHeader     = "X-Wit-Confirm"
+	confirmHTML       = "<html><body><form action='%s' method='post'><input type='hidden' name='confirm' value='yes'/><button type='submit'>Confirm ON ({{ .System }})</button></form></body></html>"
+	alignCycles       = 3
+	stateRetryDelay   = 500 * time.Millisecond
+	schedulerTick     = 5 * time.Second
+	irsendRetryDelay  = 500 * time.Millisecond
+	irsendTimeout     = 5 * time.Second
+	shutdownTimeout   = 10 * time.Second
+	historyLines      = 50
+	webhookTimeout    = 10 * time.Second
+	pipeTimeout       = 250 * time.Millisecond
+	maxHistory        = 1000
+	reportDateFormat  = "2006-01-02"
 )
 
 type (
@@ -44,7 +135,19 @@ type (
 		System         string
 		Manual         string
 		Override       string
+		Scheduled      string
 		Schedule       string
+		NextMode       string
+		Paused         string
+		LastChanged    string
+		NextChange     string
+		Day            string
+		Days           []string
+		Entries        []ScheduleEntry
+		Default        string
+		Token          string
+		Base           string
+		Remote         string
 		Build          string
 		OperationModes []string
 	}
@@ -52,67 +155,288 @@ type (
 		hour   int
 		min    int
 		action string
+		mode   string
+		day    string
+		line   string
+		sun    string
+		offset time.Duration
 	}
 	context struct {
-		cfg           Configuration
-		stateFile     string
-		pageTemplate  *template.Template
-		errorTemplate *template.Template
+		cfg             Configuration
+		stateFile       string
+		historyFile     string
+		pageTemplate    *template.Template
+		errorTemplate   *template.Template
+		confirmTemplate *template.Template
+		last            *lastCommand
+		trace           *latestTrace
+		cache           *stateCache
+		metrics         *counters
+		remote          *liveRemote
+		warned          *warnedOnce
+		// scheduleMode is the mode named by the schedule entry being acted on, if any
+		scheduleMode string
 	}
 	// Configuration is the wit configuration file definition.
 	Configuration struct {
-		Binding  string            `json:"binding"`
-		LIRC     LIRCConfiguration `json:"lirc"`
-		Cache    string            `json:"cache"`
-		lircName string
-		opModes  []string
-		version  string
+		Binding                string                       `json:"binding"`
+		LIRC                   LIRCConfiguration            `json:"lirc"`
+		Cache                  string                       `json:"cache"`
+		PrettyJSON             bool                         `json:"prettyjson"`
+		LogThrottle            int                          `json:"logthrottle"`
+		PersistOverride        bool                         `json:"persistoverride"`
+		Static                 string                       `json:"static"`
+		Baseline               string                       `json:"baseline"`
+		DefaultAction          string                       `json:"defaultaction"`
+		LogLevel               string                       `json:"loglevel"`
+		ActionTimeout          int                          `json:"actiontimeout"`
+		Reactuate              bool                         `json:"reactuate"`
+		Timezone               string                       `json:"timezone"`
+		ConfirmOn              bool                         `json:"confirmon"`
+		StateFile              string                       `json:"statefile"`
+		CreateStateDir         bool                         `json:"createstatedir"`
+		Pipe                   string                       `json:"pipe"`
+		ManualGrace            int                          `json:"manualgrace"`
+		OverrideTimeout        int                          `json:"overridetimeout"`
+		MaxModes               int                          `json:"maxmodes"`
+		GateCommand            []string                     `json:"gatecommand"`
+		GateTimeout            int                          `json:"gatetimeout"`
+		StateRetries           int                          `json:"stateretries"`
+		GETMutationsDisabled   bool                         `json:"getmutationsdisabled"`
+		PanicFile              string                       `json:"panicfile"`
+		DisplayMaxAge          int                          `json:"displaymaxage"`
+		MaxModeLength          int                          `json:"maxmodelength"`
+		BasePath               string                       `json:"basepath"`
+		Endpoint               string                       `json:"endpoint"`
+		SchedulerJitterSeconds int                          `json:"schedulerjitterseconds"`
+		RequireScheduleToken   bool                         `json:"requirescheduletoken"`
+		CalibrateActuates      bool                         `json:"calibrateactuates"`
+		Cooldown               int                          `json:"cooldown"`
+		PollInterval           int                          `json:"pollinterval"`
+		Latitude               float64                      `json:"latitude"`
+		Longitude              float64                      `json:"longitude"`
+		Labels                 string                       `json:"labels"`
+		IRSendRetries          int                          `json:"irsendretries"`
+		IRRepeat               int                          `json:"irrepeat"`
+		IRSendTimeout          int                          `json:"irsendtimeout"`
+		DryRun                 bool                         `json:"dryrun"`
+		TLSCert                string                       `json:"tlscert"`
+		TLSKey                 string                       `json:"tlskey"`
+		WebhookURL             string                       `json:"webhookurl"`
+		Remotes                map[string]LIRCConfiguration `json:"remotes"`
+		Username               string                       `json:"username"`
+		Password               string                       `json:"password"`
+		location               *time.Location
+		lircName               string
+		remoteName             string
+		opModes                []string
+		version                string
 	}
 	// LIRCConfiguration is the backing LIRC requirements to run lirc.
 	LIRCConfiguration struct {
-		Socket string   `json:"socket"`
-		Config string   `json:"config"`
-		IRSend string   `json:"irsend"`
-		Daemon bool     `json:"daemon"`
-		Args   []string `json:"args"`
+		Socket        string            `json:"socket"`
+		Config        string            `json:"config"`
+		IRSend        string            `json:"irsend"`
+		Daemon        bool              `json:"daemon"`
+		Args          []string          `json:"args"`
+		ModeMap       map[string]string `json:"modemap"`
+		SendVerb      string            `json:"sendverb"`
+		StartVerb     string            `json:"startverb"`
+		StopVerb      string            `json:"stopverb"`
+		Format        string            `json:"format"`
+		CheckConfig   bool              `json:"checkconfig"`
+		StartSuffix   string            `json:"startsuffix"`
+		StopSuffix    string            `json:"stopsuffix"`
+		DaemonTimeout int               `json:"daemontimeout"`
+	}
+
+	// ScheduleRequest is a schedule update, submitted as a form or a JSON body.
+	// A nil Sched means the schedule was not submitted and is left as-is.
+	ScheduleRequest struct {
+		OpMode string  `json:"opmode"`
+		Manual bool    `json:"manual"`
+		Sched  *string `json:"sched"`
+		Day    string  `json:"day"`
+		Token  string  `json:"token"`
+	}
+
+	// ScheduleEntry is a single parsed schedule time, as exported by schedule.json.
+	ScheduleEntry struct {
+		Hour   int    `json:"hour"`
+		Minute int    `json:"minute"`
+		Day    string `json:"day"`
+		Action string `json:"action"`
+		Mode   string `json:"mode,omitempty"`
+		Sun    string `json:"sun,omitempty"`
+	}
+
+	// counters are the metrics totals, updated atomically
+	counters struct {
+		actuations      uint64
+		schedulerErrors uint64
+	}
+
+	// actionError is an action failure answered with a specific HTTP status.
+	actionError struct {
+		status int
+		err    error
+	}
+
+	// Webhook is posted to WebhookURL when the unit turns on or off.
+	Webhook struct {
+		Running bool   `json:"running"`
+		OpMode  string `json:"opmode"`
+		Source  string `json:"source"`
+	}
+
+	// Status is the full state along with the modes and build, for dashboards.
+	Status struct {
+		State   *State
+		OpModes []string
+		Version string
+	}
+
+	// OverrideStatus reports an override and when the scheduler will clear it, if it will.
+	OverrideStatus struct {
+		Active    bool       `json:"active"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
+
+	// SchedulePreview is what a schedule does now and at its next change today, if it changes again today.
+	SchedulePreview struct {
+		Action     string    `json:"action"`
+		Mode       string    `json:"mode"`
+		Line       string    `json:"line"`
+		HasNext    bool      `json:"hasNext"`
+		NextTime   time.Time `json:"nextTime"`
+		NextAction string    `json:"nextAction"`
+		NextMode   string    `json:"nextMode"`
+		NextLine   string    `json:"nextLine"`
+	}
+
+	// ScheduleExport is a day's schedule (or the all days one) as structured entries.
+	ScheduleExport struct {
+		Day     string          `json:"day"`
+		Default string          `json:"default,omitempty"`
+		Entries []ScheduleEntry `json:"entries"`
+		Token   string          `json:"token,omitempty"`
 	}
 
 	// State represents on the current system state to persist to disk.
 	State struct {
-		OpMode   string
-		Schedule string
-		Manual   bool
-		Override bool
-		Running  bool
+		OpMode          string
+		Schedule        string
+		Manual          bool
+		Override        bool
+		Running         bool
+		ScheduleEnabled bool
+		RunningMode     string
+		NextMode        string
+		SchemaVersion   int
+		PausedUntil     time.Time
+		LastManual      time.Time
+		// DaySchedules replace Schedule (which applies to all days) on their day
+		DaySchedules map[string]string
+		// History holds the latest maxHistory on/off transitions, oldest first
+		History []Transition
+		// LastChanged is when a code was last sent to the unit, by any source
+		LastChanged time.Time
+		// Panic is set while the panic file is present, the unit is kept off
+		Panic bool
+		// OverrideUntil is when the scheduler clears a web override, zero when it only clears at midnight
+		OverrideUntil time.Time
+	}
+	Transition struct {
+		Time    time.Time
+		Running bool
+		Mode    string
+	}
+	DayRuntime struct {
+		Date    string `json:"date"`
+		Seconds int64  `json:"seconds"`
+	}
+	// Command is an irsend invocation and how it exited.
+	Command struct {
+		Args     []string  `json:"args"`
+		ExitCode int       `json:"exitCode"`
+		Error    string    `json:"error"`
+		Time     time.Time `json:"time"`
+	}
+	lastCommand struct {
+		sync.Mutex
+		command *Command
+	}
+	// remote is what was parsed from the LIRC config along with the lirc settings, replaced as a whole on reload
+	remote struct {
+		name  string
+		modes []string
+		lirc  LIRCConfiguration
+	}
+	liveRemote struct {
+		sync.RWMutex
+		remote remote
+	}
+	// Trace is how the scheduler decided what to do on its most recent tick.
+	Trace struct {
+		Time    time.Time `json:"time"`
+		Line    string    `json:"line"`
+		Action  string    `json:"action"`
+		Outcome string    `json:"outcome"`
+		Reason  string    `json:"reason"`
+		Error   string    `json:"error"`
+	}
+	// stateCache holds the last state file contents read or written, edits on disk are seen via mtime/size.
+	stateCache struct {
+		data    []byte
+		modTime time.Time
+		size    int64
+	}
+	latestTrace struct {
+		sync.Mutex
+		trace *Trace
+	}
+	// warnedOnce is the warnings already logged, for problems that would otherwise be logged on every tick
+	warnedOnce struct {
+		sync.Mutex
+		seen map[string]bool
+	}
+	// Capabilities describes the schedule grammar and actions supported, for generic front-ends.
+	Capabilities struct {
+		Actions   []string `json:"actions"`
+		ReadOnly  []string `json:"readOnly"`
+		DayTypes  []string `json:"dayTypes"`
+		DayNames  []string `json:"dayNames"`
+		Baselines []string `json:"baselines"`
+		Features  []string `json:"features"`
+	}
+	configFiles  []string
+	throttledLog struct {
+		message string
+		window  time.Duration
+		last    string
+		count   int
+		since   time.Time
 	}
 )
 
+// parseConfigName is everything after a leading 'name', which may contain spaces.
 func parseConfigName(line string) string {
-	if strings.HasPrefix(line, "name ") {
-		parts := strings.Split(line, " ")
-		if len(parts) == 2 {
-			return parts[1]
-		}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "name" {
+		return ""
 	}
-	return ""
+	return strings.Join(fields[1:], " ")
 }
 
-func (c *Configuration) parseLIRCConfig() error {
-	if !pathExists(c.LIRC.Config) {
-		return errors.New("config file for lirc does not exist")
-	}
-	var modes []string
+// parseClassicLIRC reads the remote name and raw code names from a lircd.conf 'begin remote' block.
+func parseClassicLIRC(data string) (string, []string) {
 	lircName := ""
-	data, err := os.ReadFile(c.LIRC.Config)
-	if err != nil {
-		return err
-	}
+	var codes []string
 	inRaw := false
 	lastLine := ""
-	modes = []string{}
-	uniques := make(map[string]int)
-	for _, line := range strings.Split(string(data), "\n") {
-		trimmed := strings.TrimSpace(line)
+	for _, line := range strings.Split(data, "\n") {
+		// fields may be separated by any run of spaces or tabs
+		trimmed := strings.Join(strings.Fields(line), " ")
 		if trimmed == "" {
 			continue
 		}
@@ -126,21 +450,7 @@ func (c *Configuration) parseLIRCConfig() error {
 				break
 			}
 			if name := parseConfigName(trimmed); name != "" {
-				if strings.HasSuffix(name, commandStart) {
-					name = name[:len(name)-len(commandStart)]
-				} else if strings.HasSuffix(name, commandStop) {
-					name = name[:len(name)-len(commandStop)]
-				} else {
-					return errors.New("unknown mode, not start/top")
-				}
-				val, ok := uniques[name]
-				if !ok {
-					modes = append(modes, name)
-					val = 1
-				} else {
-					val++
-				}
-				uniques[name] = val
+				codes = append(codes, name)
 			}
 		} else {
 			if trimmed == "begin raw_codes" {
@@ -149,34 +459,246 @@ func (c *Configuration) parseLIRCConfig() error {
 		}
 		lastLine = trimmed
 	}
+	return lircName, codes
+}
+
+// parseTOMLLIRC reads the remote name and code names from the TOML-style layout:
+//
+//	[remote]
+//	name = "BRYANT"
+//
+//	[codes]
+//	COOL72START = "4415 4394 554 1578 ..."
+//	COOL72STOP = "4415 4373 575 1578 ..."
+func parseTOMLLIRC(data string) (string, []string, error) {
+	lircName := ""
+	var codes []string
+	section := ""
+	for _, line := range strings.Split(data, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			continue
+		}
+		pair := strings.SplitN(trimmed, "=", 2)
+		if len(pair) != 2 {
+			return "", nil, fmt.Errorf("invalid lirc config line: %s", trimmed)
+		}
+		key := strings.TrimSpace(pair[0])
+		switch section {
+		case "remote":
+			if key == "name" {
+				lircName = strings.Trim(strings.TrimSpace(pair[1]), `"`)
+			}
+		case "codes":
+			codes = append(codes, key)
+		}
+	}
+	return lircName, codes, nil
+}
+
+func (c Configuration) maxModes() int {
+	if c.MaxModes > 0 {
+		return c.MaxModes
+	}
+	return maxModes
+}
+
+func (l LIRCConfiguration) checkConfig() error {
+	if !pathExists(l.Config) {
+		return fmt.Errorf("config file for lirc does not exist: %s", l.Config)
+	}
+	return nil
+}
+
+// checkModeName keeps mode names short and to characters safe for irsend arguments and the UI.
+func (c Configuration) checkModeName(name string) error {
+	limit := maxModeLength
+	if c.MaxModeLength > 0 {
+		limit = c.MaxModeLength
+	}
+	if name == "" || len(name) > limit {
+		return fmt.Errorf("invalid mode name length (%d), must be 1 to %d characters: %q", len(name), limit, name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return fmt.Errorf("invalid character %q in mode name: %q", r, name)
+		}
+	}
+	return nil
+}
+
+func (c *Configuration) parseLIRCConfig() error {
+	if err := c.LIRC.checkConfig(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(c.LIRC.Config)
+	if err != nil {
+		return err
+	}
+	var lircName string
+	var codes []string
+	switch c.LIRC.Format {
+	case "", lircClassic:
+		lircName, codes = parseClassicLIRC(string(data))
+	case lircTOML:
+		lircName, codes, err = parseTOMLLIRC(string(data))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown lirc config format: %s", c.LIRC.Format)
+	}
+	start, stop := c.LIRC.suffix(true), c.LIRC.suffix(false)
+	if start == stop {
+		return fmt.Errorf("start and stop suffixes must differ: %s", start)
+	}
+	modes := []string{}
+	uniques := make(map[string]int)
+	for _, name := range codes {
+		if strings.HasSuffix(name, start) {
+			name = name[:len(name)-len(start)]
+		} else if strings.HasSuffix(name, stop) {
+			name = name[:len(name)-len(stop)]
+		} else {
+			return fmt.Errorf("unknown mode, not %s/%s: %s", start, stop, name)
+		}
+		if err := c.checkModeName(name); err != nil {
+			return err
+		}
+		val, ok := uniques[name]
+		if !ok {
+			modes = append(modes, name)
+			val = 1
+		} else {
+			val++
+		}
+		uniques[name] = val
+	}
 	if len(modes) == 0 || lircName == "" {
 		return errors.New("failed parsing lirc config for necessary values")
 	}
+	if maxModes := c.maxModes(); len(modes) > maxModes {
+		return fmt.Errorf("too many modes (%d), at most %d are allowed", len(modes), maxModes)
+	}
 	for k, v := range uniques {
 		if v != 2 {
 			return fmt.Errorf("mismatch start/stop: %s", k)
 		}
 	}
+	if len(c.LIRC.ModeMap) > 0 {
+		canonical := []string{}
+		for k, v := range c.LIRC.ModeMap {
+			if _, ok := uniques[v]; !ok {
+				return fmt.Errorf("mode map %s refers to unknown mode: %s", k, v)
+			}
+			canonical = append(canonical, k)
+		}
+		modes = canonical
+	}
 	sort.Strings(modes)
 	c.opModes = modes
 	c.lircName = lircName
 	return nil
 }
 
+func newState() *State {
+	return &State{ScheduleEnabled: true, SchemaVersion: len(stateMigrations)}
+}
+
+// migrate upgrades a state read from an older file to the current schema version.
+func (s *State) migrate() {
+	for s.SchemaVersion < len(stateMigrations) {
+		stateMigrations[s.SchemaVersion](s)
+		s.SchemaVersion++
+	}
+}
+
+// setOverride starts an override, expiring after timeout when one is given.
+func (s *State) setOverride(timeout time.Duration) {
+	s.Override = true
+	s.OverrideUntil = time.Time{}
+	if timeout > 0 {
+		s.OverrideUntil = time.Now().Add(timeout)
+	}
+}
+
+// setRunning tracks whether the unit is running and in which mode it was started.
+func (s *State) setRunning(running bool, opMode string) {
+	if running != s.Running {
+		s.History = append(s.History, Transition{Time: time.Now(), Running: running, Mode: opMode})
+		if len(s.History) > maxHistory {
+			s.History = s.History[len(s.History)-maxHistory:]
+		}
+	}
+	s.Running = running
+	s.RunningMode = ""
+	if running {
+		s.RunningMode = opMode
+	}
+}
+
+// runningMode is the mode the unit was started in, falling back to the selected mode.
+func (s *State) runningMode() string {
+	if s.Running && s.RunningMode != "" {
+		return s.RunningMode
+	}
+	return s.OpMode
+}
+
+// read returns the cached state file contents when the file on disk is unchanged, callers hold the lock.
+func (c *stateCache) read(info os.FileInfo) []byte {
+	if c.data == nil || !info.ModTime().Equal(c.modTime) || info.Size() != c.size {
+		return nil
+	}
+	return c.data
+}
+
+func (c *stateCache) store(data []byte, info os.FileInfo) {
+	c.data = data
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+}
+
+// getStateRetry reads the state, retrying a failed read up to StateRetries times (e.g. a backup briefly holding the file).
+func (ctx context) getStateRetry() (*State, error) {
+	for attempt := 0; ; attempt++ {
+		state, err := ctx.getState()
+		if err == nil || attempt >= ctx.cfg.StateRetries {
+			return state, err
+		}
+		logDebug(fmt.Sprintf("retrying state read (%v)", err))
+		time.Sleep(stateRetryDelay)
+	}
+}
+
 func (ctx context) getState() (*State, error) {
 	lock.Lock()
 	defer lock.Unlock()
-	if !pathExists(ctx.stateFile) {
-		return &State{}, nil
-	}
-	b, err := os.ReadFile(ctx.stateFile)
+	info, err := os.Stat(ctx.stateFile)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return newState(), nil
+		}
 		return nil, err
 	}
-	obj := &State{}
+	b := ctx.cache.read(info)
+	if b == nil {
+		b, err = os.ReadFile(ctx.stateFile)
+		if err != nil {
+			return nil, err
+		}
+		ctx.cache.store(b, info)
+	}
+	obj := newState()
+	obj.SchemaVersion = 0
 	if err := json.Unmarshal(b, &obj); err != nil {
 		return nil, err
 	}
+	obj.migrate()
 	return obj, nil
 }
 
@@ -189,135 +711,1174 @@ func pathExists(path string) bool {
 	return true
 }
 
-func (ctx context) setState(s *State) error {
+// readStateFile returns the raw state file, or the default state when nothing has been saved yet.
+func (ctx context) readStateFile() ([]byte, error) {
 	lock.Lock()
 	defer lock.Unlock()
-	b, err := json.Marshal(s)
+	b, err := os.ReadFile(ctx.stateFile)
+	if os.IsNotExist(err) {
+		return ctx.marshal(newState())
+	}
+	return b, err
+}
+
+func (ctx context) marshal(v interface{}) ([]byte, error) {
+	if ctx.cfg.PrettyJSON {
+		return json.MarshalIndent(v, "", "    ")
+	}
+	return json.Marshal(v)
+}
+
+// writeAtomic replaces path through a synced temporary file in the same directory,
+// a power loss leaves either the old or the new contents and never a partial file.
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.*", filepath.Base(path)))
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(ctx.stateFile, b, 0644)
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
-func doScheduled(ctx context) error {
-	state, err := ctx.getState()
-	if err != nil {
+// setState saves the state and then publishes it, the pipe is written without holding the state lock.
+func (ctx context) setState(s *State) error {
+	if err := ctx.saveState(s); err != nil {
 		return err
 	}
-	action, err := parseSchedule(state.Schedule)
+	ctx.publish(s)
+	return nil
+}
+
+func (ctx context) saveState(s *State) error {
+	lock.Lock()
+	defer lock.Unlock()
+	b, err := ctx.marshal(s)
 	if err != nil {
 		return err
 	}
-	if action != noAction {
-		return act(action, true, nil, ctx)
+	if err := writeAtomic(ctx.stateFile, b); err != nil {
+		return err
+	}
+	info, err := os.Stat(ctx.stateFile)
+	if err != nil {
+		return err
 	}
+	ctx.cache.store(b, info)
 	return nil
 }
 
-func schedulerDaemon(ctx context) {
-	today := time.Now()
-	fmt.Println("scheduler started")
-	for {
-		time.Sleep(5 * time.Second)
-		now := time.Now()
-		state, err := ctx.getState()
-		if err == nil {
-			if now.Day() != today.Day() || state.Manual {
-				if state.Override {
-					state.Override = false
-					if err := ctx.setState(state); err != nil {
-						logError("unable to writeback override disable", err)
-					}
-				}
+// publish writes the compact status to the configured pipe, skipping it when no reader is attached
+// and dropping the line when a reader stops draining the pipe for longer than pipeTimeout.
+func (ctx context) publish(s *State) {
+	if ctx.cfg.Pipe == "" {
+		return
+	}
+	pipe, err := os.OpenFile(ctx.cfg.Pipe, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if !errors.Is(err, syscall.ENXIO) {
+			logWarn("unable to open state pipe", err)
+		}
+		return
+	}
+	defer pipe.Close()
+	if err := pipe.SetWriteDeadline(time.Now().Add(pipeTimeout)); err != nil {
+		logWarn("unable to set state pipe deadline", err)
+		return
+	}
+	if _, err := fmt.Fprintln(pipe, s.runningState(ctx.cfg.Labels)); err != nil {
+		logWarn("unable to write state pipe", err)
+	}
+}
+
+func (c Configuration) makePipe() error {
+	info, err := os.Stat(c.Pipe)
+	if err == nil {
+		if info.Mode()&os.ModeNamedPipe == 0 {
+			return fmt.Errorf("not a named pipe: %s", c.Pipe)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return syscall.Mkfifo(c.Pipe, 0644)
+}
+
+func doScheduled(ctx context) error {
+	trace := &Trace{Time: time.Now()}
+	err := ctx.runSchedule(trace)
+	if err != nil {
+		trace.Error = err.Error()
+	}
+	ctx.trace.set(trace)
+	logDebug(fmt.Sprintf("schedule trace: line '%s', action '%s', outcome '%s' %s", trace.Line, trace.Action, trace.Outcome, trace.Reason))
+	return err
+}
+
+// runSchedule resolves the schedule and actuates, recording each decision in trace.
+func (ctx context) runSchedule(trace *Trace) error {
+	state, err := ctx.getStateRetry()
+	if err != nil {
+		return err
+	}
+	trace.Outcome = outcomeSuppressed
+	switch {
+	case state.Panic:
+		trace.Reason = "panic"
+	case state.Manual:
+		trace.Reason = "manual"
+	case !state.ScheduleEnabled:
+		trace.Reason = "schedule disabled"
+	case time.Now().Before(state.PausedUntil):
+		trace.Reason = "paused"
+	case time.Now().Before(state.LastManual.Add(ctx.cfg.manualGrace())):
+		trace.Reason = "manual grace"
+	}
+	if trace.Reason != "" {
+		return nil
+	}
+	now := time.Now()
+	timing, err := ctx.resolveScheduleAt(state.scheduleFor(dayName(now.In(ctx.cfg.location).Weekday())), now)
+	if err != nil {
+		return err
+	}
+	trace.Line = timing.line
+	trace.Action = timing.action
+	switch {
+	case timing.action == noAction:
+		trace.Outcome = outcomeNone
+	case state.Override:
+		trace.Reason = "override"
+	case (timing.action == onAction) == state.Running && (timing.mode == "" || !state.Running || timing.mode == state.runningMode()):
+		trace.Outcome = outcomeUnchanged
+	default:
+		scheduled := ctx
+		scheduled.scheduleMode = timing.mode
+		if err := act(timing.action, true, nil, scheduled); err != nil {
+			if errors.Is(err, errCooldown) {
+				// retried on a later tick once the cooldown passes
+				trace.Reason = "cooldown"
+				return nil
 			}
-			if !state.Manual {
-				if err := doScheduled(ctx); err != nil {
-					logError("scheduler failed", err)
-				}
+			if errors.Is(err, errGateDenied) {
+				// still returned so the denial is logged (throttled) by the scheduler
+				trace.Reason = "gate"
 			}
-		} else {
-			logError("unable to read state", err)
+			return err
 		}
-		today = now
+		trace.Outcome = outcomeActuated
 	}
+	return nil
 }
 
-func logError(message string, err error) {
-	msg := message
-	if err != nil {
-		msg = fmt.Sprintf("%s (%v)", msg, err)
+func (l *latestTrace) set(trace *Trace) {
+	l.Lock()
+	defer l.Unlock()
+	l.trace = trace
+}
+
+func (l *latestTrace) get() *Trace {
+	l.Lock()
+	defer l.Unlock()
+	return l.trace
+}
+
+// warn logs a warning the first time it is seen.
+func (w *warnedOnce) warn(message string, err error) {
+	w.Lock()
+	defer w.Unlock()
+	key := fmt.Sprintf("%s: %v", message, err)
+	if w.seen[key] {
+		return
+	}
+	if w.seen == nil {
+		w.seen = make(map[string]bool)
 	}
-	fmt.Fprintln(os.Stderr, msg)
+	w.seen[key] = true
+	logWarn(message, err)
 }
 
-func quit(message string, err error) {
-	logError(message, err)
-	os.Exit(1)
+// actionTimeout is the deadline for a web request's actions, a negative setting disables it.
+func (c Configuration) actionTimeout() time.Duration {
+	if c.ActionTimeout == 0 {
+		return actionTimeout
+	}
+	return time.Duration(c.ActionTimeout) * time.Second
 }
 
-func newScheduleTime(hr, min int, action string) scheduleTime {
-	return scheduleTime{hour: hr, min: min, action: action}
+// manualGrace is how long the scheduler defers to a web on/off before acting again.
+func (c Configuration) manualGrace() time.Duration {
+	return time.Duration(c.ManualGrace) * time.Second
 }
 
-func (c Configuration) setupServer(mux *http.ServeMux) error {
-	ctx := context{}
-	library := c.Cache
-	if !pathExists(library) {
-		if err := os.MkdirAll(library, 0755); err != nil {
-			quit("unable to make library dir", err)
-		}
+// markManual records a web on/off, which overrides the schedule unless a manual grace
+// window is configured, the schedule then resumes on its own once the window passes.
+func (ctx context) markManual(state *State) {
+	state.LastManual = time.Now()
+	if ctx.cfg.manualGrace() == 0 && !state.Manual && state.ScheduleEnabled {
+		state.setOverride(ctx.cfg.overrideTimeout())
 	}
-	ctx.cfg = c
-	ctx.stateFile = filepath.Join(library, "state.json")
-	tmpl, err := template.New("error").Parse("<html><body>{{ .Error }}</body></html>")
-	if err != nil {
-		quit("invalid template for errors", err)
+}
+
+// overrideTimeout is how long a web override lasts, without one it lasts until midnight.
+func (c Configuration) overrideTimeout() time.Duration {
+	if c.OverrideTimeout > 0 {
+		return time.Duration(c.OverrideTimeout) * time.Second
 	}
-	ctx.errorTemplate = tmpl
-	page, err := template.New("page").Parse(templateHTML)
-	if err != nil {
-		quit("unable to read html template", err)
+	return 0
+}
+
+func (c Configuration) logWindow() time.Duration {
+	if c.LogThrottle > 0 {
+		return time.Duration(c.LogThrottle) * time.Second
 	}
-	ctx.pageTemplate = page
-	go schedulerDaemon(ctx)
-	mux.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
-		doActionCall(w, r, ctx)
-	})
+	return logWindow
+}
 
-	return nil
+func newThrottledLog(message string, window time.Duration) *throttledLog {
+	return &throttledLog{message: message, window: window, since: time.Now()}
 }
 
-func act(action string, isChange bool, req *http.Request, ctx context) error {
-	webRequest := req != nil
-	canChange := true
-	state, err := ctx.getState()
-	if err != nil {
-		return err
+// log writes the first of a run of identical errors and then only a periodic summary.
+func (t *throttledLog) log(err error) {
+	text := fmt.Sprintf("%v", err)
+	if text != t.last {
+		t.flush()
+		t.last = text
+		logError(t.message, err)
+		return
 	}
-	if state.Override && !webRequest {
-		canChange = false
+	t.count++
+	if time.Since(t.since) >= t.window {
+		t.flush()
 	}
-	if isChange {
-		switch action {
-		case "calibrate":
-			state.Running = !state.Running
+}
+
+func (t *throttledLog) flush() {
+	if t.count > 0 {
+		logError(fmt.Sprintf("%s %d times in the last %s", t.message, t.count, time.Since(t.since).Round(time.Second)), errors.New(t.last))
+	}
+	t.count = 0
+	t.since = time.Now()
+}
+
+func (t *throttledLog) reset() {
+	t.flush()
+	t.last = ""
+}
+
+// cooldown keeps the unit from being actuated again within Cooldown seconds of the last time, whatever the source.
+func (ctx context) cooldown(state *State) error {
+	window := time.Duration(ctx.cfg.Cooldown) * time.Second
+	if window <= 0 {
+		return nil
+	}
+	wait := time.Until(state.LastChanged.Add(window))
+	if wait > 0 {
+		return &actionError{status: http.StatusTooManyRequests, err: fmt.Errorf("%w, try again in %s", errCooldown, wait.Round(time.Second))}
+	}
+	return nil
+}
+
+// panicTriggered is true while the panic file exists, unless it holds "0".
+func (c Configuration) panicTriggered() bool {
+	if c.PanicFile == "" {
+		return false
+	}
+	data, err := os.ReadFile(c.PanicFile)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) != "0"
+}
+
+// checkPanic forces the unit off when the panic file appears and releases it once the file clears.
+func (ctx context) checkPanic(state *State) error {
+	triggered := ctx.cfg.panicTriggered()
+	if triggered == state.Panic {
+		return nil
+	}
+	state.Panic = triggered
+	if triggered {
+		logWarn(fmt.Sprintf("panic file present, forcing off: %s", ctx.cfg.PanicFile), nil)
+		if state.Running {
+			if err := ctx.send(gocontext.Background(), state, state.runningMode(), false); err != nil {
+				return err
+			}
+			state.setRunning(false, "")
+			ctx.appendHistory(offAction, state, false)
+			ctx.notify(state, false)
+		}
+	} else {
+		logInfo("panic file cleared")
+	}
+	return ctx.setState(state)
+}
+
+// pollInterval is how often the scheduler runs, PollInterval seconds or the default tick.
+func (c Configuration) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return schedulerTick
+}
+
+func (c Configuration) checkPollInterval() error {
+	if c.PollInterval < 0 {
+		return fmt.Errorf("poll interval must be positive: %d", c.PollInterval)
+	}
+	return nil
+}
+
+// schedulerSleep is the poll interval, moved randomly by up to SchedulerJitterSeconds either way.
+func (c Configuration) schedulerSleep(jitter *rand.Rand) time.Duration {
+	tick := c.pollInterval()
+	if c.SchedulerJitterSeconds <= 0 {
+		return tick
+	}
+	spread := time.Duration(c.SchedulerJitterSeconds) * time.Second
+	sleep := tick - spread + time.Duration(jitter.Int63n(int64(2*spread)+1))
+	if sleep < time.Second {
+		return time.Second
+	}
+	return sleep
+}
+
+func schedulerDaemon(ctx context, stop gocontext.Context, done *sync.WaitGroup) {
+	defer done.Done()
+	today := time.Now()
+	failures := newThrottledLog("scheduler failed", ctx.cfg.logWindow())
+	// manual mode clears any override when it is entered, a restart while manual is not entering it
+	wasManual := false
+	if state, err := ctx.getState(); err == nil {
+		wasManual = state.Manual
+	}
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	logInfo("scheduler started")
+	for {
+		select {
+		case <-stop.Done():
+			logInfo("scheduler stopped")
+			return
+		case <-time.After(ctx.cfg.schedulerSleep(jitter)):
+		}
+		now := time.Now()
+		manual, err := ctx.maintain(now, today, wasManual)
+		if err != nil {
+			logError("unable to read state", err)
+		} else if err := doScheduled(ctx); err != nil {
+			atomic.AddUint64(&ctx.metrics.schedulerErrors, 1)
+			failures.log(err)
+		} else {
+			failures.reset()
+		}
+		wasManual = manual
+		today = now
+	}
+}
+
+// maintain handles the panic file and clears an override at midnight (since last), when manual mode
+// is entered or once it expires. The state is read and written back under the action lock so a web
+// action in between is not lost, it returns whether the state is manual.
+func (ctx context) maintain(now, last time.Time, wasManual bool) (bool, error) {
+	actionLock.Lock()
+	defer actionLock.Unlock()
+	state, err := ctx.getStateRetry()
+	if err != nil {
+		return wasManual, err
+	}
+	if err := ctx.checkPanic(state); err != nil {
+		logError("unable to handle panic file", err)
+	}
+	rollover := now.In(ctx.cfg.location).Day() != last.In(ctx.cfg.location).Day() && !ctx.cfg.PersistOverride
+	enteredManual := state.Manual && !wasManual
+	expired := !state.OverrideUntil.IsZero() && now.After(state.OverrideUntil)
+	if rollover || enteredManual || expired {
+		if state.Override || expired {
+			state.Override = false
+			state.OverrideUntil = time.Time{}
 			if err := ctx.setState(state); err != nil {
+				logError("unable to writeback override disable", err)
+			}
+		}
+	}
+	return state.Manual, nil
+}
+
+func parseLogLevel(name string) (int, error) {
+	if name == "" {
+		return levelInfo, nil
+	}
+	for level, levelName := range logLevels {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level: %s", name)
+}
+
+func logAt(level int, message string, err error) {
+	if level < logLevel {
+		return
+	}
+	msg := fmt.Sprintf("[%s] %s", logLevels[level], message)
+	if err != nil {
+		msg = fmt.Sprintf("%s (%v)", msg, err)
+	}
+	out := os.Stdout
+	if level >= levelWarn {
+		out = os.Stderr
+	}
+	fmt.Fprintln(out, msg)
+}
+
+func logDebug(message string) {
+	logAt(levelDebug, message, nil)
+}
+
+func logInfo(message string) {
+	logAt(levelInfo, message, nil)
+}
+
+func logWarn(message string, err error) {
+	logAt(levelWarn, message, err)
+}
+
+func logError(message string, err error) {
+	logAt(levelError, message, err)
+}
+
+func quit(message string, err error) {
+	logError(message, err)
+	os.Exit(1)
+}
+
+func newScheduleTime(hr, min int, action string) scheduleTime {
+	return scheduleTime{hour: hr, min: min, action: action}
+}
+
+// checkStateDir makes sure the state file's directory exists (creating it when allowed) and is writable.
+func (c Configuration) checkStateDir(stateFile string) error {
+	dir := filepath.Dir(stateFile)
+	if !pathExists(dir) {
+		if !c.CreateStateDir {
+			return fmt.Errorf("directory does not exist: %s", dir)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return checkWritable(dir)
+}
+
+// healthy is whether the state can be read and the cache written, without touching the IR hardware.
+func (ctx context) healthy() error {
+	if _, err := ctx.getState(); err != nil {
+		return err
+	}
+	return checkWritable(ctx.cfg.Cache)
+}
+
+func checkWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".wit-*")
+	if err != nil {
+		return fmt.Errorf("directory is not writable: %s (%v)", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Validate checks the settings wit cannot run without, reporting every problem found at once.
+func (c Configuration) Validate() error {
+	var problems []string
+	if c.Binding == "" {
+		problems = append(problems, "binding is not set")
+	}
+	if c.Cache == "" {
+		problems = append(problems, "cache is not set")
+	} else if pathExists(c.Cache) {
+		if err := checkWritable(c.Cache); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.LIRC.Socket == "" {
+		problems = append(problems, "lirc socket is not set")
+	}
+	if c.LIRC.IRSend == "" {
+		problems = append(problems, "lirc irsend is not set")
+	}
+	if c.LIRC.Config == "" {
+		problems = append(problems, "lirc config is not set")
+	} else if !pathExists(c.LIRC.Config) {
+		problems = append(problems, fmt.Sprintf("lirc config does not exist: %s", c.LIRC.Config))
+	}
+	var remotes []string
+	for name := range c.Remotes {
+		remotes = append(remotes, name)
+	}
+	sort.Strings(remotes)
+	for _, name := range remotes {
+		remote := c.Remotes[name]
+		if remote.Socket == "" {
+			problems = append(problems, fmt.Sprintf("remote %s lirc socket is not set", name))
+		}
+		if remote.IRSend == "" {
+			problems = append(problems, fmt.Sprintf("remote %s lirc irsend is not set", name))
+		}
+		if err := remote.checkVerbs(); err != nil {
+			problems = append(problems, fmt.Sprintf("remote %s %v", name, err))
+		}
+	}
+	if err := c.LIRC.checkVerbs(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid timezone: %v", err))
+		}
+	}
+	if _, err := c.baseline(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.checkDefaultAction(); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid default action: %v", err))
+	}
+	for _, check := range []func() error{c.checkPollInterval, c.checkLabels, c.checkTLS} {
+		if err := check(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.Latitude < -90 || c.Latitude > 90 {
+		problems = append(problems, fmt.Sprintf("latitude is out of range: %v", c.Latitude))
+	}
+	if c.Longitude < -180 || c.Longitude > 180 {
+		problems = append(problems, fmt.Sprintf("longitude is out of range: %v", c.Longitude))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (c Configuration) newContext() context {
+	ctx := context{}
+	library := c.Cache
+	if !pathExists(library) {
+		if err := os.MkdirAll(library, 0755); err != nil {
+			quit("unable to make library dir", err)
+		}
+	}
+	ctx.cfg = c
+	ctx.stateFile = filepath.Join(library, "state.json")
+	ctx.historyFile = filepath.Join(library, "history.log")
+	if c.StateFile != "" {
+		ctx.stateFile = c.StateFile
+	}
+	if err := c.checkStateDir(ctx.stateFile); err != nil {
+		quit("unable to use state file directory", err)
+	}
+	if c.Pipe != "" {
+		if err := c.makePipe(); err != nil {
+			quit("unable to make state pipe", err)
+		}
+	}
+	ctx.last = &lastCommand{}
+	ctx.trace = &latestTrace{}
+	ctx.cache = &stateCache{}
+	ctx.metrics = &counters{}
+	ctx.warned = &warnedOnce{}
+	ctx.remote = &liveRemote{}
+	ctx.remote.set(c)
+	tmpl, err := template.New("error").Parse("<html><body>{{ .Error }}</body></html>")
+	if err != nil {
+		quit("invalid template for errors", err)
+	}
+	ctx.errorTemplate = tmpl
+	page, err := template.New("page").Parse(templateHTML)
+	if err != nil {
+		quit("unable to read html template", err)
+	}
+	ctx.pageTemplate = page
+	confirm, err := template.New("confirm").Parse(fmt.Sprintf(confirmHTML, c.link(onAction)))
+	if err != nil {
+		quit("invalid template for confirmation", err)
+	}
+	ctx.confirmTemplate = confirm
+	return ctx
+}
+
+// link is the URL the browser uses for an action, behind a reverse proxy the endpoint is served under BasePath.
+func (c Configuration) link(action string) string {
+	return strings.TrimSuffix(c.BasePath, "/") + c.actionPath() + action
+}
+
+// actionPath is where the actions are served, named remotes are under the endpoint by name.
+func (c Configuration) actionPath() string {
+	if c.remoteName == "" {
+		return c.endpoint()
+	}
+	return c.endpoint() + c.remoteName + "/"
+}
+
+// endpoint is the configured Endpoint with a leading and trailing slash, /wit/ by default.
+func (c Configuration) endpoint() string {
+	if c.Endpoint == "" {
+		return defaultEndpoint
+	}
+	trimmed := strings.Trim(c.Endpoint, "/")
+	if trimmed == "" {
+		return "/"
+	}
+	return "/" + trimmed + "/"
+}
+
+// forRemote is the configuration for a named remote, which keeps its own state under the cache.
+func (c Configuration) forRemote(name string) (Configuration, error) {
+	remote := c
+	remote.LIRC = c.Remotes[name]
+	remote.Remotes = nil
+	remote.remoteName = name
+	remote.Cache = filepath.Join(c.Cache, name)
+	remote.StateFile = ""
+	remote.Pipe = ""
+	if err := remote.checkModeName(name); err != nil {
+		return remote, fmt.Errorf("invalid remote name: %w", err)
+	}
+	// a remote is routed by its first path segment, so it must not shadow a nested action such as override/status
+	for _, action := range append(readActions, writeActions...) {
+		if strings.SplitN(action, "/", 2)[0] == name {
+			return remote, fmt.Errorf("remote name is an action: %s", name)
+		}
+	}
+	if err := remote.LIRC.checkVerbs(); err != nil {
+		return remote, err
+	}
+	if err := remote.parseLIRCConfig(); err != nil {
+		return remote, fmt.Errorf("remote %s: %w", name, err)
+	}
+	return remote, nil
+}
+
+// remoteConfigs are the configurations of the named remotes, in name order.
+func (c Configuration) remoteConfigs() ([]Configuration, error) {
+	var names []string
+	for name := range c.Remotes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var remotes []Configuration
+	for _, name := range names {
+		remote, err := c.forRemote(name)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
+	return remotes, nil
+}
+
+// cronLines translates the stored schedules into crontab lines that call wit, a day with
+// its own schedule only gets that day's lines.
+func (ctx context) cronLines() ([]string, error) {
+	state, err := ctx.getState()
+	if err != nil {
+		return nil, err
+	}
+	host := ctx.cfg.Binding
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	scheme := "http"
+	if ctx.cfg.TLSCert != "" {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, host, ctx.cfg.actionPath())
+	curl := "curl -s"
+	if ctx.cfg.Username != "" {
+		curl = fmt.Sprintf("%s -u %s", curl, cronQuote(ctx.cfg.Username+":"+ctx.cfg.Password))
+	}
+	var lines []string
+	if ctx.cfg.Timezone != "" {
+		lines = append(lines, fmt.Sprintf("CRON_TZ=%s", ctx.cfg.Timezone))
+	}
+	for _, day := range append([]string{allDays}, dayNames...) {
+		schedule := state.Schedule
+		if day != allDays {
+			own, ok := state.DaySchedules[day]
+			if !ok {
+				continue
+			}
+			schedule = own
+		}
+		entries, directive, err := parseScheduleTimes(schedule)
+		if err != nil {
+			return nil, err
+		}
+		baseline, err := ctx.cfg.baseline()
+		if directive != "" {
+			baseline, err = parseBaseline(directive)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if baseline != noAction {
+			entries = append([]scheduleTime{newScheduleTime(0, 0, baseline)}, entries...)
+			entries[0].day = "*"
+		}
+		for _, entry := range entries {
+			if entry.sun != "" {
+				lines = append(lines, fmt.Sprintf("# not expressible in cron, the sun time moves: %s", entry.line))
+				continue
+			}
+			var days []int
+			for idx, name := range dayNames {
+				_, own := state.DaySchedules[name]
+				if (day == allDays && own) || (day != allDays && name != day) {
+					continue
+				}
+				// dayIndex is Monday first, the weekday of idx is one after it (with Sunday at 7)
+				if matched, _ := matchesDay(entry.day, time.Weekday((idx+1)%7)); matched {
+					days = append(days, idx+1)
+				}
+			}
+			if len(days) == 0 {
+				continue
+			}
+			command := fmt.Sprintf("%s -X POST %s%s", curl, url, entry.action)
+			if entry.mode != "" {
+				command = fmt.Sprintf("%s -X POST -d mode=%s -d action=%s %sapply", curl, entry.mode, entry.action, url)
+			} else if entry.action == onAction && ctx.cfg.ConfirmOn {
+				command = fmt.Sprintf("%s -H '%s: yes'", command, confirmHeader)
+			}
+			lines = append(lines, fmt.Sprintf("%d %d * * %s %s", entry.min, entry.hour, cronDays(days), command))
+		}
+	}
+	return lines, nil
+}
+
+// cronQuote single quotes a shell word, escaping the % that cron would turn into a newline.
+func cronQuote(word string) string {
+	return "'" + strings.NewReplacer("'", `'\''`, "%", `\%`).Replace(word) + "'"
+}
+
+// cronDays writes cron day of week numbers (Monday 1 to Sunday 7) compactly.
+func cronDays(days []int) string {
+	if len(days) == len(dayNames) {
+		return "*"
+	}
+	var fields []string
+	for start := 0; start < len(days); {
+		end := start
+		for end+1 < len(days) && days[end+1] == days[end]+1 {
+			end++
+		}
+		if end > start {
+			fields = append(fields, fmt.Sprintf("%d-%d", days[start], days[end]))
+		} else {
+			fields = append(fields, strconv.Itoa(days[start]))
+		}
+		start = end + 1
+	}
+	return strings.Join(fields, ",")
+}
+
+// checkDefaultAction makes sure the endpoint root only ever maps to an action that does not mutate state.
+func (c *Configuration) checkDefaultAction() error {
+	if c.DefaultAction == "" {
+		c.DefaultAction = isDisplay
+	}
+	for _, action := range readActions {
+		if action == c.DefaultAction {
+			return nil
+		}
+	}
+	return fmt.Errorf("not a read action: %s", c.DefaultAction)
+}
+
+func (c Configuration) serveFavicon(w http.ResponseWriter, r *http.Request) {
+	if c.Static != "" {
+		if icon := filepath.Join(c.Static, "favicon.ico"); pathExists(icon) {
+			http.ServeFile(w, r, icon)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/x-icon")
+	http.ServeContent(w, r, "favicon.ico", time.Time{}, bytes.NewReader(favicon))
+}
+
+// setupServer registers the handlers and starts a scheduler for the remote and each named remote,
+// which run until stop is done and then close the returned channel.
+func (c Configuration) setupServer(mux *http.ServeMux, stop gocontext.Context) ([]context, <-chan struct{}, error) {
+	remotes, err := c.remoteConfigs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var contexts []context
+	schedulers := &sync.WaitGroup{}
+	for _, cfg := range append([]Configuration{c}, remotes...) {
+		ctx := cfg.newContext()
+		if err := ctx.checkOpMode(); err != nil {
+			return nil, nil, err
+		}
+		schedulers.Add(1)
+		go schedulerDaemon(ctx, stop, schedulers)
+		mux.HandleFunc(cfg.actionPath(), func(w http.ResponseWriter, r *http.Request) {
+			if !c.authorized(r) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="wit"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			doActionCall(w, r, ctx)
+		})
+		contexts = append(contexts, ctx)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		schedulers.Wait()
+		close(stopped)
+	}()
+	mux.HandleFunc("/favicon.ico", c.serveFavicon)
+	if c.Static != "" {
+		mux.Handle(staticEndpoint, http.StripPrefix(staticEndpoint, http.FileServer(http.Dir(c.Static))))
+	}
+
+	return contexts, stopped, nil
+}
+
+// checkOpMode moves a selected mode that is no longer in the LIRC config, or not yet set, to the first known mode.
+func (ctx context) checkOpMode() error {
+	actionLock.Lock()
+	defer actionLock.Unlock()
+	state, err := ctx.getState()
+	if err != nil {
+		return err
+	}
+	if ctx.validMode(state.OpMode) == nil {
+		return nil
+	}
+	modes := ctx.remote.get().modes
+	// a fresh state has no mode yet, it simply starts with the default
+	if state.OpMode != "" {
+		logWarn(fmt.Sprintf("selected mode '%s' is unknown, using '%s'", state.OpMode, modes[0]), nil)
+	}
+	state.OpMode = modes[0]
+	return ctx.setState(state)
+}
+
+func (ctx context) validMode(opMode string) error {
+	if len(strings.TrimSpace(opMode)) == 0 {
+		return errors.New("mode not set")
+	}
+	for _, m := range ctx.remote.get().modes {
+		if m == opMode {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid mode: %s", opMode)
+}
+
+// mode resolves the LIRC code name to send for an operating mode.
+func (ctx context) mode(opMode string, isOn bool) (string, error) {
+	if err := ctx.validMode(opMode); err != nil {
+		return "", err
+	}
+	lirc := ctx.remote.get().lirc
+	if mapped, ok := lirc.ModeMap[opMode]; ok {
+		opMode = mapped
+	}
+	return fmt.Sprintf("%s%s", opMode, lirc.suffix(isOn)), nil
+}
+
+// suffix is the code name postfix for turning on (START) or off (STOP) a mode.
+func (l LIRCConfiguration) suffix(isOn bool) string {
+	if isOn {
+		if l.StartSuffix != "" {
+			return l.StartSuffix
+		}
+		return commandStart
+	}
+	if l.StopSuffix != "" {
+		return l.StopSuffix
+	}
+	return commandStop
+}
+
+// sendVerb is the irsend verb turning on or off, StartVerb/StopVerb take precedence over SendVerb.
+func (l LIRCConfiguration) sendVerb(isOn bool) (string, error) {
+	want := l.SendVerb
+	if isOn && l.StartVerb != "" {
+		want = l.StartVerb
+	}
+	if !isOn && l.StopVerb != "" {
+		want = l.StopVerb
+	}
+	if want == "" {
+		return defaultVerb, nil
+	}
+	for _, verb := range sendVerbs {
+		if verb == want {
+			return verb, nil
+		}
+	}
+	return "", fmt.Errorf("invalid irsend verb: %s", want)
+}
+
+func (l LIRCConfiguration) checkVerbs() error {
+	for _, isOn := range []bool{true, false} {
+		if _, err := l.sendVerb(isOn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestContext bounds actuation by the web request's deadline, scheduled actions have none.
+func requestContext(req *http.Request) gocontext.Context {
+	if req == nil {
+		return gocontext.Background()
+	}
+	return req.Context()
+}
+
+// gate runs the configured gate command, a non-zero exit or running past the gate timeout denies turning on.
+func (ctx context) gate(rctx gocontext.Context) error {
+	if len(ctx.cfg.GateCommand) == 0 {
+		return nil
+	}
+	gateCtx, cancel := gocontext.WithTimeout(rctx, ctx.cfg.gateTimeout())
+	defer cancel()
+	if err := exec.CommandContext(gateCtx, ctx.cfg.GateCommand[0], ctx.cfg.GateCommand[1:]...).Run(); err != nil {
+		if errors.Is(gateCtx.Err(), gocontext.DeadlineExceeded) {
+			err = fmt.Errorf("timed out: %w", gateCtx.Err())
+		}
+		return fmt.Errorf("%w (%v)", errGateDenied, err)
+	}
+	return nil
+}
+
+// gateTimeout bounds the gate command, GateTimeout seconds or the irsend timeout by default.
+func (c Configuration) gateTimeout() time.Duration {
+	if c.GateTimeout > 0 {
+		return time.Duration(c.GateTimeout) * time.Second
+	}
+	return c.irsendTimeout()
+}
+
+// send actuates the unit and records when it did on the state, for the cooldown and display.
+func (ctx context) send(rctx gocontext.Context, state *State, opMode string, isOn bool) error {
+	if err := ctx.actuate(rctx, opMode, isOn); err != nil {
+		return err
+	}
+	state.LastChanged = time.Now()
+	return nil
+}
+
+func (ctx context) actuate(rctx gocontext.Context, opMode string, isOn bool) error {
+	// the lirc settings come from the live remote so a reload's verbs and irsend apply
+	cfg := ctx.cfg
+	cfg.LIRC = ctx.remote.get().lirc
+	if cfg.LIRC.CheckConfig {
+		if err := cfg.LIRC.checkConfig(); err != nil {
+			return err
+		}
+	}
+	useMode, err := ctx.mode(opMode, isOn)
+	if err != nil {
+		return err
+	}
+	verb, err := cfg.LIRC.sendVerb(isOn)
+	if err != nil {
+		return err
+	}
+	if ctx.cfg.DryRun {
+		logInfo(fmt.Sprintf("dry run, not sending: %s %s %s", verb, ctx.remote.get().name, useMode))
+		return nil
+	}
+	lircName := ctx.remote.get().name
+	retries := ctx.cfg.irsendRetries()
+	timeout := ctx.cfg.irsendTimeout()
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := gocontext.WithTimeout(rctx, timeout)
+		cmd := exec.CommandContext(attemptCtx, cfg.LIRC.IRSend, cfg.irsendArgs(verb, lircName, useMode)...)
+		out, err := cmd.CombinedOutput()
+		if output := strings.TrimSpace(string(out)); err != nil && output != "" {
+			err = fmt.Errorf("%w: %s", err, output)
+		}
+		if errors.Is(attemptCtx.Err(), gocontext.DeadlineExceeded) {
+			err = fmt.Errorf("irsend timed out sending %s: %w", useMode, attemptCtx.Err())
+		}
+		cancel()
+		atomic.AddUint64(&ctx.metrics.actuations, 1)
+		ctx.last.set(cmd, err)
+		if err == nil || attempt >= retries || rctx.Err() != nil {
+			return err
+		}
+		logWarn(fmt.Sprintf("irsend failed, retrying (%d/%d)", attempt+1, retries), err)
+		time.Sleep(irsendRetryDelay)
+	}
+}
+
+// irsendArgs are the irsend arguments, SEND_ONCE repeats the code IRRepeat times when configured.
+func (c Configuration) irsendArgs(verb, lircName, useMode string) []string {
+	args := []string{fmt.Sprintf("--device=%s", c.LIRC.Socket)}
+	if verb == defaultVerb && c.IRRepeat > 1 {
+		args = append(args, fmt.Sprintf("--count=%d", c.IRRepeat))
+	}
+	return append(args, verb, lircName, useMode)
+}
+
+// irsendTimeout bounds each irsend call, IRSendTimeout seconds or a few seconds by default.
+func (c Configuration) irsendTimeout() time.Duration {
+	if c.IRSendTimeout > 0 {
+		return time.Duration(c.IRSendTimeout) * time.Second
+	}
+	return irsendTimeout
+}
+
+// irsendRetries is how many more times a failed irsend is tried, once unless configured (negative disables).
+func (c Configuration) irsendRetries() int {
+	if c.IRSendRetries < 0 {
+		return 0
+	}
+	if c.IRSendRetries == 0 {
+		return 1
+	}
+	return c.IRSendRetries
+}
+
+// invalidInput marks an error as the client's, failing the request with a 400.
+func invalidInput(err error) error {
+	return &actionError{status: http.StatusBadRequest, err: err}
+}
+
+func (e *actionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *actionError) Unwrap() error {
+	return e.err
+}
+
+func (l *lastCommand) set(cmd *exec.Cmd, err error) {
+	l.Lock()
+	defer l.Unlock()
+	command := &Command{Args: cmd.Args, ExitCode: -1, Time: time.Now()}
+	if cmd.ProcessState != nil {
+		command.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		command.Error = err.Error()
+	}
+	l.command = command
+}
+
+func (l *liveRemote) set(c Configuration) {
+	l.Lock()
+	defer l.Unlock()
+	l.remote = remote{name: c.lircName, modes: c.opModes, lirc: c.LIRC}
+}
+
+func (l *liveRemote) get() remote {
+	l.RLock()
+	defer l.RUnlock()
+	return l.remote
+}
+
+func (l *lastCommand) get() *Command {
+	l.Lock()
+	defer l.Unlock()
+	return l.command
+}
+
+// align sends the current mode's start/stop codes slowly so the transmitter can be aimed.
+func (ctx context) align() error {
+	state, err := ctx.getState()
+	if err != nil {
+		return err
+	}
+	for cycle := 1; cycle <= alignCycles; cycle++ {
+		for _, isOn := range []bool{true, false} {
+			time.Sleep(alignDelay)
+			useMode, err := ctx.mode(state.OpMode, isOn)
+			if err != nil {
 				return err
 			}
-		case onAction, offAction:
-			if !state.Manual {
-				if webRequest {
-					state.Override = true
-					if err := ctx.setState(state); err != nil {
-						return err
-					}
+			logInfo(fmt.Sprintf("align %d/%d: sending %s", cycle, alignCycles, useMode))
+			if err := ctx.send(gocontext.Background(), state, state.OpMode, isOn); err != nil {
+				return err
+			}
+		}
+	}
+	state.setRunning(false, "")
+	return ctx.setState(state)
+}
+
+func act(action string, isChange bool, req *http.Request, ctx context) error {
+	if isChange {
+		actionLock.Lock()
+		defer actionLock.Unlock()
+	}
+	webRequest := req != nil
+	canChange := true
+	state, err := ctx.getState()
+	if err != nil {
+		return err
+	}
+	if state.Override && !webRequest {
+		canChange = false
+	}
+	wasRunning := state.Running
+	if isChange {
+		if action == "toggle" {
+			// a toggle is the on or off that flips the tracked state
+			action = onAction
+			if state.Running {
+				action = offAction
+			}
+		}
+		switch action {
+		case "calibrate":
+			if ctx.cfg.CalibrateActuates {
+				isOn := !state.Running
+				if isOn && state.Panic {
+					return errPanic
 				}
+				if err := ctx.cooldown(state); err != nil {
+					return err
+				}
+				if err := ctx.send(requestContext(req), state, state.runningMode(), isOn); err != nil {
+					return err
+				}
+			}
+			state.setRunning(!state.Running, state.OpMode)
+			if err := ctx.setState(state); err != nil {
+				return err
 			}
+		case onAction, offAction:
 			isOn := action == onAction
+			actuating := false
+			switching := isOn && state.Running && ctx.scheduleMode != "" && ctx.scheduleMode != state.runningMode()
 			if canChange {
-				actuating := false
 				if isOn {
-					if !state.Running {
+					if !state.Running || switching {
 						actuating = true
 					}
 				} else {
@@ -325,149 +1886,1008 @@ func act(action string, isChange bool, req *http.Request, ctx context) error {
 						actuating = true
 					}
 				}
-				if actuating {
-					if len(strings.TrimSpace(state.OpMode)) == 0 {
-						return errors.New("mode not set")
-					}
-					valid := false
-					for _, m := range ctx.cfg.opModes {
-						if m == state.OpMode {
-							valid = true
-							break
-						}
-					}
-					if !valid {
-						return fmt.Errorf("invalid mode: %s", state.OpMode)
-					}
-					postfix := commandStop
-					if isOn {
-						postfix = commandStart
-					}
-					useMode := fmt.Sprintf("%s%s", state.OpMode, postfix)
-					if err := exec.Command(ctx.cfg.LIRC.IRSend, fmt.Sprintf("--device=%s", ctx.cfg.LIRC.Socket), "SEND_ONCE", ctx.cfg.lircName, useMode).Run(); err != nil {
-						return err
-					}
-					state.Running = !state.Running
-					if err := ctx.setState(state); err != nil {
+			}
+			// a refused action is not a manual change, nothing is marked or written until these pass
+			if actuating {
+				if isOn && state.Panic {
+					return errPanic
+				}
+				if isOn {
+					if err := ctx.gate(requestContext(req)); err != nil {
 						return err
 					}
 				}
+				if err := ctx.cooldown(state); err != nil {
+					return err
+				}
+			}
+			if webRequest {
+				ctx.markManual(state)
+			}
+			if actuating {
+				opMode := state.runningMode()
+				if isOn && ctx.scheduleMode != "" {
+					opMode = ctx.scheduleMode
+				}
+				oneShot := isOn && !webRequest && !switching && state.NextMode != ""
+				if oneShot {
+					opMode = state.NextMode
+				}
+				if err := ctx.send(requestContext(req), state, opMode, isOn); err != nil {
+					return err
+				}
+				state.setRunning(isOn, opMode)
+				if oneShot {
+					state.NextMode = ""
+				}
+			}
+			if webRequest || actuating {
+				if err := ctx.setState(state); err != nil {
+					return err
+				}
+			}
+		case "forceoff":
+			// sent whatever the tracked state is, for when it no longer matches the unit
+			ctx.markManual(state)
+			if err := ctx.send(requestContext(req), state, state.runningMode(), false); err != nil {
+				return err
+			}
+			state.setRunning(false, "")
+			if err := ctx.setState(state); err != nil {
+				return err
+			}
+		case "setmode":
+			selectedMode := strings.TrimSpace(req.FormValue("mode"))
+			if err := ctx.validMode(selectedMode); err != nil {
+				return invalidInput(err)
+			}
+			if state.Running && selectedMode != state.runningMode() {
+				if err := ctx.cooldown(state); err != nil {
+					return err
+				}
+				if err := ctx.send(requestContext(req), state, selectedMode, true); err != nil {
+					return err
+				}
+				state.setRunning(true, selectedMode)
+			}
+			state.OpMode = selectedMode
+			if err := ctx.setState(state); err != nil {
+				return err
+			}
+		case "apply":
+			selectedMode := strings.TrimSpace(req.FormValue("mode"))
+			if err := ctx.validMode(selectedMode); err != nil {
+				return invalidInput(err)
+			}
+			target := req.FormValue("action")
+			if target != onAction && target != offAction {
+				return invalidInput(fmt.Errorf("apply action can only be 'on' or 'off': %s", target))
+			}
+			isOn := target == onAction
+			ctx.markManual(state)
+			if isOn && (!state.Running || state.runningMode() != selectedMode) {
+				if state.Panic {
+					return errPanic
+				}
+				if err := ctx.gate(requestContext(req)); err != nil {
+					return err
+				}
+				if err := ctx.cooldown(state); err != nil {
+					return err
+				}
+				if err := ctx.send(requestContext(req), state, selectedMode, true); err != nil {
+					return err
+				}
+				state.setRunning(true, selectedMode)
+			}
+			if !isOn && state.Running {
+				if err := ctx.cooldown(state); err != nil {
+					return err
+				}
+				if err := ctx.send(requestContext(req), state, state.runningMode(), false); err != nil {
+					return err
+				}
+				state.setRunning(false, "")
+			}
+			state.OpMode = selectedMode
+			if err := ctx.setState(state); err != nil {
+				return err
+			}
+		case "nextmode":
+			selectedMode := strings.TrimSpace(req.FormValue("mode"))
+			if selectedMode != "" {
+				if err := ctx.validMode(selectedMode); err != nil {
+					return invalidInput(err)
+				}
+			}
+			state.NextMode = selectedMode
+			if err := ctx.setState(state); err != nil {
+				return err
+			}
+		case "reset":
+			if req.FormValue("confirm") != "yes" {
+				return invalidInput(errors.New("reset requires confirm=yes"))
+			}
+			fresh := newState()
+			if req.FormValue("keep") == "schedule" {
+				fresh.Schedule = state.Schedule
+				fresh.DaySchedules = state.DaySchedules
+			}
+			if err := ctx.setState(fresh); err != nil {
+				return err
+			}
+		case "pause":
+			state.PausedUntil = time.Time{}
+			if duration := strings.TrimSpace(req.FormValue("duration")); duration != "" {
+				pause, err := time.ParseDuration(duration)
+				if err != nil {
+					return invalidInput(err)
+				}
+				if pause < 0 {
+					return invalidInput(errors.New("pause duration must be positive"))
+				}
+				state.PausedUntil = time.Now().Add(pause)
+			}
+			if err := ctx.setState(state); err != nil {
+				return err
 			}
 		case "togglelock":
 			state.Override = !state.Override
+			// a lock is held until midnight, not the web override timeout
+			state.OverrideUntil = time.Time{}
+			if err := ctx.setState(state); err != nil {
+				return err
+			}
+		case "toggleschedule":
+			state.ScheduleEnabled = !state.ScheduleEnabled
 			if err := ctx.setState(state); err != nil {
 				return err
 			}
 		case "schedule":
-			if err := req.ParseForm(); err != nil {
+			update, err := readScheduleRequest(req)
+			if err != nil {
+				return invalidInput(err)
+			}
+			if err := update.apply(ctx, state); err != nil {
 				return err
 			}
-			isManual := false
-			schedule := ""
-			for k, v := range req.Form {
-				switch k {
-				case "opmode":
-					selectedMode := strings.TrimSpace(strings.Join(v, ""))
-					if selectedMode != "noop" {
-						state.OpMode = selectedMode
-					}
-				case "manual":
-					isManual = true
-				case "sched":
-					schedule = strings.Join(v, "\n")
-					if _, err := parseSchedule(schedule); err != nil {
-						return err
-					}
+			if ctx.cfg.Reactuate && state.Running && state.OpMode != state.runningMode() {
+				if err := ctx.cooldown(state); err != nil {
+					return err
+				}
+				if err := ctx.send(requestContext(req), state, state.OpMode, true); err != nil {
+					return err
 				}
+				state.setRunning(true, state.OpMode)
+			}
+			if err := ctx.setState(state); err != nil {
+				return err
+			}
+		case "scheduletable":
+			table, err := readScheduleTable(req)
+			if err != nil {
+				return invalidInput(err)
+			}
+			if err := ctx.checkScheduleToken(state, table.Day, table.Token); err != nil {
+				return err
+			}
+			schedule := table.text()
+			if _, err := ctx.parseSchedule(schedule); err != nil {
+				return invalidInput(err)
+			}
+			if err := state.setSchedule(table.Day, schedule); err != nil {
+				return invalidInput(err)
+			}
+			if err := ctx.setState(state); err != nil {
+				return err
+			}
+		case scheduleJSON:
+			imported := ScheduleExport{}
+			if err := json.NewDecoder(req.Body).Decode(&imported); err != nil {
+				return invalidInput(err)
+			}
+			if err := ctx.checkScheduleToken(state, imported.Day, imported.Token); err != nil {
+				return err
+			}
+			schedule := imported.text()
+			if _, err := ctx.parseSchedule(schedule); err != nil {
+				return invalidInput(err)
+			}
+			if err := state.setSchedule(imported.Day, schedule); err != nil {
+				return invalidInput(err)
 			}
-			state.Manual = isManual
-			state.Schedule = strings.TrimSpace(schedule)
 			if err := ctx.setState(state); err != nil {
 				return err
 			}
 		default:
-			logError(fmt.Sprintf("unknown action: %s", action), nil)
-			return nil
+			// doActionCall only passes known actions, one without a case here was never wired up
+			return fmt.Errorf("action is not handled: %s", action)
+		}
+		switch action {
+		case onAction, offAction, "calibrate", "forceoff", "apply":
+			ctx.appendHistory(action, state, webRequest)
+		}
+		if state.Running != wasRunning {
+			ctx.notify(state, webRequest)
 		}
 		return nil
 	}
 	return nil
 }
 
-func parseSchedule(schedule string) (string, error) {
-	current := time.Now()
-	isWeekend := false
-	if weekday := current.Weekday(); weekday == time.Sunday || weekday == time.Saturday {
-		isWeekend = true
+// notify posts the new running state to the webhook in the background, failures are only logged.
+func (ctx context) notify(state *State, webRequest bool) {
+	if ctx.cfg.WebhookURL == "" {
+		return
 	}
-	tracking := newScheduleTime(0, 0, offAction)
-	timings := []scheduleTime{tracking}
-	for _, line := range strings.Split(strings.TrimSpace(schedule), "\n") {
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	event := Webhook{Running: state.Running, OpMode: state.runningMode(), Source: "schedule"}
+	if webRequest {
+		event.Source = "web"
+	}
+	go func() {
+		b, err := json.Marshal(event)
+		if err != nil {
+			logError("unable to encode webhook", err)
+			return
 		}
-		parts := strings.Split(strings.TrimSpace(line), " ")
-		if len(parts) != 4 {
-			return "", errors.New("invalid schedule line, should be 'min hour action'")
+		client := &http.Client{Timeout: webhookTimeout}
+		resp, err := client.Post(ctx.cfg.WebhookURL, "application/json", bytes.NewReader(b))
+		if err != nil {
+			logError("webhook failed", err)
+			return
 		}
-		toggle := parts[3]
-		if toggle != onAction && toggle != offAction {
-			return "", errors.New("schedule can only be 'on' or 'off'")
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logError("webhook failed", fmt.Errorf("status %s", resp.Status))
 		}
-		hour, err := strconv.Atoi(parts[1])
-		if err != nil {
-			return "", err
+	}()
+}
+
+// appendHistory adds a line for an on/off style action to the history log.
+func (ctx context) appendHistory(action string, state *State, webRequest bool) {
+	source := "schedule"
+	if webRequest {
+		source = "web"
+	}
+	line := fmt.Sprintf("%s action=%s mode=%s running=%t source=%s\n", time.Now().Format(timeFormat), action, state.runningMode(), state.Running, source)
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	file, err := os.OpenFile(ctx.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logWarn("unable to open history log", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.WriteString(line); err != nil {
+		logWarn("unable to write history log", err)
+	}
+}
+
+// readHistory is the last count lines of the history log.
+func (ctx context) readHistory(count int) ([]string, error) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	b, err := os.ReadFile(ctx.historyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
-		if hour < 0 || hour > 23 {
-			return "", errors.New("hour is invalid")
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return lines, nil
+}
+
+func dayName(day time.Weekday) string {
+	return dayNames[dayIndex(day)]
+}
+
+// dayIndex orders days Monday first so ranges such as sat-sun run forward.
+func dayIndex(day time.Weekday) int {
+	return (int(day) + 6) % 7
+}
+
+func parseDayName(name string) (int, error) {
+	for idx, day := range dayNames {
+		if day == name {
+			return idx, nil
 		}
-		min, err := strconv.Atoi(parts[0])
+	}
+	return 0, fmt.Errorf("invalid day name: %s", name)
+}
+
+func matchesDay(dayType string, day time.Weekday) (bool, error) {
+	isWeekend := day == time.Sunday || day == time.Saturday
+	switch dayType {
+	case "*", everydayType, allDays:
+		return true, nil
+	case weekendType:
+		return isWeekend, nil
+	case weekdayType:
+		return !isWeekend, nil
+	}
+	bounds := strings.Split(dayType, "-")
+	if len(bounds) == 1 {
+		single, err := parseDayName(dayType)
 		if err != nil {
-			return "", err
+			return false, fmt.Errorf("invalid day type: %s", dayType)
 		}
-		if min < 0 || min > 59 {
-			return "", errors.New("minute is invalid")
+		return dayIndex(day) == single, nil
+	}
+	if len(bounds) != 2 {
+		return false, fmt.Errorf("invalid day type: %s", dayType)
+	}
+	start, err := parseDayName(bounds[0])
+	if err != nil {
+		return false, err
+	}
+	end, err := parseDayName(bounds[1])
+	if err != nil {
+		return false, err
+	}
+	if start > end {
+		return false, fmt.Errorf("day range must run from mon to sun: %s", dayType)
+	}
+	today := dayIndex(day)
+	return today >= start && today <= end, nil
+}
+
+func validateScheduleTime(hour, min int) error {
+	if hour < 0 || hour > 23 {
+		return errors.New("hour is invalid")
+	}
+	if min < 0 || min > 59 {
+		return errors.New("minute is invalid")
+	}
+	return nil
+}
+
+func parseScheduleClock(clock string) (int, int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("invalid schedule time, should be 'HH:MM'")
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	min, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := validateScheduleTime(hour, min); err != nil {
+		return 0, 0, err
+	}
+	return hour, min, nil
+}
+
+func isSunTime(field string) bool {
+	return strings.HasPrefix(field, sunrise) || strings.HasPrefix(field, sunset)
+}
+
+// parseSunTime reads the offset of 'sunrise' or 'sunset', optionally followed by a signed duration (e.g. 'sunset-30m').
+func parseSunTime(field string) (time.Duration, error) {
+	offset := strings.TrimPrefix(strings.TrimPrefix(field, sunrise), sunset)
+	if offset == "" {
+		return 0, nil
+	}
+	if !strings.HasPrefix(offset, "+") && !strings.HasPrefix(offset, "-") {
+		return 0, fmt.Errorf("invalid sun time, should be 'sunrise|sunset[+-offset]': %s", field)
+	}
+	duration, err := time.ParseDuration(offset)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= -24*time.Hour || duration >= 24*time.Hour {
+		return 0, fmt.Errorf("sun time offset must be within a day: %s", field)
+	}
+	return duration, nil
+}
+
+// resolveSun sets a sunrise/sunset entry's time for the day of current, kept within that day.
+func (ctx context) resolveSun(timing scheduleTime, current time.Time) (scheduleTime, error) {
+	if ctx.cfg.Latitude == 0 && ctx.cfg.Longitude == 0 {
+		return timing, errors.New("sunrise/sunset schedule entries need latitude and longitude configured")
+	}
+	rise, set, ok := sunTimes(current, ctx.cfg.Latitude, ctx.cfg.Longitude)
+	if !ok {
+		return timing, fmt.Errorf("the sun does not rise and set on %s", current.Format("2006-01-02"))
+	}
+	at := rise
+	if strings.HasPrefix(timing.sun, sunset) {
+		at = set
+	}
+	at = at.Add(timing.offset).In(ctx.cfg.location)
+	year, month, day := current.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, ctx.cfg.location)
+	switch {
+	case at.Before(start):
+		timing.hour, timing.min = 0, 0
+	case !at.Before(start.AddDate(0, 0, 1)):
+		timing.hour, timing.min = 23, 59
+	default:
+		timing.hour, timing.min = at.Hour(), at.Minute()
+	}
+	return timing, nil
+}
+
+// sunTimes are the day's sunrise and sunset from the sunrise equation, false when the sun does not rise or set.
+func sunTimes(day time.Time, latitude, longitude float64) (time.Time, time.Time, bool) {
+	const (
+		rad      = math.Pi / 180
+		unixDay  = 2440587.5
+		j2000Day = 2451545.0
+	)
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, time.UTC)
+	meanNoon := float64(noon.Unix())/86400 + unixDay - j2000Day - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := j2000Day + meanNoon + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*ecliptic*rad)
+	declination := math.Asin(math.Sin(ecliptic*rad) * math.Sin(23.4397*rad))
+	cosHour := (math.Sin(-0.833*rad) - math.Sin(latitude*rad)*math.Sin(declination)) / (math.Cos(latitude*rad) * math.Cos(declination))
+	if cosHour < -1 || cosHour > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHour) / rad
+	fromJulian := func(julian float64) time.Time {
+		return time.Unix(int64(math.Round((julian-unixDay)*86400)), 0)
+	}
+	return fromJulian(transit - hourAngle/360), fromJulian(transit + hourAngle/360), true
+}
+
+// parseScheduleRange expands 'HH:MM-HH:MM' into timings (in time order) that hold action
+// within the range and the opposite action after it, wrapping past midnight when start > end.
+func parseScheduleRange(span, action string) ([]scheduleTime, error) {
+	bounds := strings.Split(span, "-")
+	if len(bounds) != 2 {
+		return nil, errors.New("invalid schedule range, should be 'HH:MM-HH:MM'")
+	}
+	startHour, startMin, err := parseScheduleClock(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	endHour, endMin, err := parseScheduleClock(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+	opposite := offAction
+	if action == offAction {
+		opposite = onAction
+	}
+	start := newScheduleTime(startHour, startMin, action)
+	end := newScheduleTime(endHour, endMin, opposite)
+	startOfDay, endOfDay := startHour*60+startMin, endHour*60+endMin
+	if startOfDay == endOfDay {
+		return nil, errors.New("schedule range is empty")
+	}
+	if startOfDay > endOfDay {
+		return []scheduleTime{newScheduleTime(0, 0, action), end, start}, nil
+	}
+	return []scheduleTime{start, end}, nil
+}
+
+func readScheduleRequest(req *http.Request) (*ScheduleRequest, error) {
+	update := &ScheduleRequest{}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(update); err != nil {
+			return nil, err
 		}
-		dayType := parts[2]
-		if dayType == weekendType || dayType == weekdayType {
-			isDayTypeWeekend := dayType == weekendType
-			if isWeekend {
-				if !isDayTypeWeekend {
-					continue
+		return update, nil
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	for k, v := range req.Form {
+		switch k {
+		case "opmode":
+			update.OpMode = strings.Join(v, "")
+		case "manual":
+			update.Manual = true
+		case "sched":
+			schedule := strings.Join(v, "\n")
+			update.Sched = &schedule
+		case "day":
+			update.Day = strings.Join(v, "")
+		case "token":
+			update.Token = strings.Join(v, "")
+		}
+	}
+	return update, nil
+}
+
+// newScheduleExport parses a schedule into structured entries, comments and variables are resolved away.
+func newScheduleExport(day, schedule string) (ScheduleExport, error) {
+	export := ScheduleExport{Day: day, Entries: []ScheduleEntry{}}
+	timings, baseline, err := parseScheduleTimes(schedule)
+	if err != nil {
+		return export, err
+	}
+	export.Default = baseline
+	for _, timing := range timings {
+		export.Entries = append(export.Entries, ScheduleEntry{Hour: timing.hour, Minute: timing.min, Day: timing.day, Action: timing.action, Mode: timing.mode, Sun: timing.sun})
+	}
+	return export, nil
+}
+
+// readScheduleTable reads the schedule table form, rows are matched up by position and rows without a time are dropped.
+func readScheduleTable(req *http.Request) (ScheduleExport, error) {
+	table := ScheduleExport{}
+	if err := req.ParseForm(); err != nil {
+		return table, err
+	}
+	table.Day = req.Form.Get("day")
+	table.Default = req.Form.Get("default")
+	table.Token = req.Form.Get("token")
+	times := req.Form["time"]
+	days := req.Form["dayof"]
+	actions := req.Form["action"]
+	modes := req.Form["entrymode"]
+	if len(times) != len(days) || len(times) != len(actions) || len(times) != len(modes) {
+		return table, errors.New("schedule table rows are incomplete")
+	}
+	for idx, clock := range times {
+		clock = strings.TrimSpace(clock)
+		if clock == "" {
+			continue
+		}
+		entry := ScheduleEntry{Day: strings.TrimSpace(days[idx]), Action: actions[idx], Mode: modes[idx]}
+		if isSunTime(clock) {
+			if _, err := parseSunTime(clock); err != nil {
+				return table, err
+			}
+			entry.Sun = clock
+		} else {
+			hour, min, err := parseScheduleClock(clock)
+			if err != nil {
+				return table, err
+			}
+			entry.Hour, entry.Minute = hour, min
+		}
+		table.Entries = append(table.Entries, entry)
+	}
+	return table, nil
+}
+
+// text rebuilds the canonical 'min hour day action' schedule lines.
+func (s ScheduleExport) text() string {
+	var lines []string
+	if s.Default != "" {
+		lines = append(lines, fmt.Sprintf("%s %s", defaultDirective, s.Default))
+	}
+	for _, entry := range s.Entries {
+		line := fmt.Sprintf("%d %d %s %s", entry.Minute, entry.Hour, entry.Day, entry.Action)
+		if entry.Sun != "" {
+			line = fmt.Sprintf("%s %s %s", entry.Sun, entry.Day, entry.Action)
+		}
+		if entry.Mode != "" {
+			line = fmt.Sprintf("%s %s", line, entry.Mode)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s ScheduleRequest) apply(ctx context, state *State) error {
+	selectedMode := strings.TrimSpace(s.OpMode)
+	if selectedMode == "noop" {
+		selectedMode = ""
+	}
+	if selectedMode != "" {
+		if err := ctx.validMode(selectedMode); err != nil {
+			return invalidInput(err)
+		}
+	}
+	if s.Sched != nil {
+		if err := ctx.checkScheduleToken(state, s.Day, s.Token); err != nil {
+			return err
+		}
+		if _, err := ctx.parseSchedule(*s.Sched); err != nil {
+			return invalidInput(err)
+		}
+		if err := state.setSchedule(s.Day, strings.TrimSpace(*s.Sched)); err != nil {
+			return invalidInput(err)
+		}
+	}
+	if selectedMode != "" {
+		state.OpMode = selectedMode
+	}
+	state.Manual = s.Manual
+	return nil
+}
+
+// expandScheduleVariables drops '@name = value' definitions and replaces later '@name' tokens with their value.
+func expandScheduleVariables(schedule string) ([]string, error) {
+	variables := make(map[string]string)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(schedule), "\n") {
+		// anything after a '#' is a comment, a line that was only a comment is then blank
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			lines = append(lines, trimmed)
+			continue
+		}
+		if strings.HasPrefix(trimmed, variablePrefix) && strings.Contains(trimmed, "=") {
+			definition := strings.SplitN(trimmed, "=", 2)
+			name := strings.TrimSpace(definition[0])
+			value := strings.TrimSpace(definition[1])
+			if name == variablePrefix || strings.ContainsAny(name, " \t") || value == "" {
+				return nil, fmt.Errorf("invalid schedule variable definition: %s", trimmed)
+			}
+			variables[name] = value
+			continue
+		}
+		if strings.HasPrefix(trimmed, variablePrefix) {
+			directive := strings.Fields(trimmed)[0]
+			if _, ok := variables[directive]; !ok {
+				if directive != defaultDirective {
+					return nil, fmt.Errorf("unknown schedule directive or undefined variable: %s", directive)
 				}
-			} else {
-				if isDayTypeWeekend {
-					continue
+				// directives are read by parseScheduleTimes
+				lines = append(lines, trimmed)
+				continue
+			}
+		}
+		var tokens []string
+		for _, token := range strings.Fields(trimmed) {
+			if strings.HasPrefix(token, variablePrefix) {
+				value, ok := variables[token]
+				if !ok {
+					return nil, fmt.Errorf("undefined schedule variable: %s", token)
+				}
+				token = value
+			}
+			tokens = append(tokens, token)
+		}
+		lines = append(lines, strings.Join(tokens, " "))
+	}
+	return lines, nil
+}
+
+// baseline is the action assumed at midnight before any schedule entry applies.
+func (c Configuration) baseline() (string, error) {
+	return parseBaseline(c.Baseline)
+}
+
+// parseBaseline reads a baseline from the config or a schedule's @default directive.
+func parseBaseline(baseline string) (string, error) {
+	switch baseline {
+	case "", offAction:
+		return offAction, nil
+	case onAction:
+		return onAction, nil
+	case baselineNone:
+		return noAction, nil
+	}
+	return "", fmt.Errorf("invalid baseline: %s", baseline)
+}
+
+// clampDST moves a wall clock time that a DST transition skips on day to the first valid time after it.
+func clampDST(day time.Time, hour, min int) (int, int) {
+	for minute := hour*60 + min; minute < 24*60; minute++ {
+		h, m := minute/60, minute%60
+		at := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, day.Location())
+		if at.Hour() == h && at.Minute() == m {
+			return h, m
+		}
+	}
+	return hour, min
+}
+
+// parseSchedule checks a schedule about to be saved, including for conflicting entries, and is its action now.
+func (ctx context) parseSchedule(schedule string) (string, error) {
+	entries, _, err := parseScheduleTimes(schedule)
+	if err != nil {
+		return "", err
+	}
+	if err := checkScheduleConflicts(entries); err != nil {
+		return "", err
+	}
+	return ctx.parseScheduleAt(schedule, time.Now())
+}
+
+// parseScheduleAt is the schedule's action at the given time.
+func (ctx context) parseScheduleAt(schedule string, now time.Time) (string, error) {
+	timing, err := ctx.resolveScheduleAt(schedule, now)
+	if err != nil {
+		return "", err
+	}
+	return timing.action, nil
+}
+
+// checkScheduleConflicts rejects entries at the same minute on a shared day that disagree,
+// identical ones are harmless.
+func checkScheduleConflicts(entries []scheduleTime) error {
+	for idx, entry := range entries {
+		for _, other := range entries[idx+1:] {
+			// sun times move day to day, so they are never a conflict here
+			if entry.sun != "" || other.sun != "" {
+				continue
+			}
+			if entry.minuteOfDay() != other.minuteOfDay() || (entry.action == other.action && entry.mode == other.mode) {
+				continue
+			}
+			for day := time.Sunday; day <= time.Saturday; day++ {
+				first, _ := matchesDay(entry.day, day)
+				second, _ := matchesDay(other.day, day)
+				if first && second {
+					return fmt.Errorf("conflicting schedule entries at %02d:%02d: '%s' and '%s'", entry.hour, entry.min, entry.line, other.line)
 				}
 			}
+		}
+	}
+	return nil
+}
+
+func (s scheduleTime) minuteOfDay() int {
+	return s.hour*60 + s.min
+}
+
+// parseScheduleTimes reads every schedule entry, for any day, in schedule order,
+// along with the schedule's @default baseline (empty when not given).
+func parseScheduleTimes(schedule string) ([]scheduleTime, string, error) {
+	lines, err := expandScheduleVariables(schedule)
+	if err != nil {
+		return nil, "", err
+	}
+	var timings []scheduleTime
+	baseline := ""
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, defaultDirective) {
+			parts := strings.Fields(line)
+			if len(parts) != 2 || parts[0] != defaultDirective {
+				return nil, "", fmt.Errorf("invalid schedule directive, should be '%s on|off|%s': %s", defaultDirective, baselineNone, line)
+			}
+			if baseline != "" {
+				return nil, "", fmt.Errorf("schedule directive given more than once: %s", defaultDirective)
+			}
+			if _, err := parseBaseline(parts[1]); err != nil {
+				return nil, "", err
+			}
+			baseline = parts[1]
+			continue
+		}
+		parts := strings.Fields(line)
+		// the fields are followed by an optional mode, a range is a single 'HH:MM-HH:MM' field
+		fields := 4
+		if strings.Contains(parts[0], ":") || isSunTime(parts[0]) {
+			fields = 3
+		}
+		if len(parts) != fields && len(parts) != fields+1 {
+			return nil, "", errors.New("invalid schedule line, should be 'min hour day action [mode]', 'HH:MM-HH:MM day action [mode]' or 'sunrise|sunset[+-offset] day action [mode]'")
+		}
+		mode := ""
+		if len(parts) > fields {
+			mode = parts[fields]
+			parts = parts[:fields]
+		}
+		toggle := parts[len(parts)-1]
+		if toggle != onAction && toggle != offAction {
+			return nil, "", errors.New("schedule can only be 'on' or 'off'")
+		}
+		var lineTracks []scheduleTime
+		if len(parts) == 3 && isSunTime(parts[0]) {
+			offset, err := parseSunTime(parts[0])
+			if err != nil {
+				return nil, "", err
+			}
+			timing := newScheduleTime(0, 0, toggle)
+			timing.sun = parts[0]
+			timing.offset = offset
+			lineTracks = []scheduleTime{timing}
+		} else if len(parts) == 3 {
+			ranged, err := parseScheduleRange(parts[0], toggle)
+			if err != nil {
+				return nil, "", err
+			}
+			lineTracks = ranged
 		} else {
-			if dayType != "*" {
-				return "", errors.New("invalid day type")
+			hour, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, "", err
+			}
+			min, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return nil, "", err
+			}
+			if err := validateScheduleTime(hour, min); err != nil {
+				return nil, "", err
+			}
+			lineTracks = []scheduleTime{newScheduleTime(hour, min, toggle)}
+		}
+		dayType := parts[len(parts)-2]
+		if _, err := matchesDay(dayType, time.Sunday); err != nil {
+			return nil, "", err
+		}
+		for idx := range lineTracks {
+			lineTracks[idx].mode = mode
+			lineTracks[idx].day = dayType
+			lineTracks[idx].line = line
+		}
+		timings = append(timings, lineTracks...)
+	}
+	return timings, baseline, nil
+}
+
+// resolveScheduleAt finds the schedule entry in effect at now, its action is noAction when there is none.
+func (ctx context) resolveScheduleAt(schedule string, now time.Time) (scheduleTime, error) {
+	none := scheduleTime{action: noAction}
+	current := now.In(ctx.cfg.location)
+	entries, directive, err := parseScheduleTimes(schedule)
+	if err != nil {
+		return none, err
+	}
+	for _, entry := range entries {
+		if entry.mode != "" {
+			if err := ctx.validMode(entry.mode); err != nil {
+				return none, err
+			}
+		}
+	}
+	// conflicts are refused when a schedule is saved, one stored before that still runs with the later entry winning
+	if err := checkScheduleConflicts(entries); err != nil {
+		ctx.warned.warn("stored schedule has conflicting entries, the later one wins", err)
+	}
+	baselineLine := "baseline"
+	baseline, err := ctx.cfg.baseline()
+	if directive != "" {
+		baselineLine = fmt.Sprintf("%s %s", defaultDirective, directive)
+		baseline, err = parseBaseline(directive)
+	}
+	if err != nil {
+		return none, err
+	}
+	timings := []scheduleTime{}
+	if baseline != noAction {
+		baselineTrack := newScheduleTime(0, 0, baseline)
+		baselineTrack.line = baselineLine
+		timings = append(timings, baselineTrack)
+	}
+	for _, entry := range entries {
+		if matched, _ := matchesDay(entry.day, current.Weekday()); matched {
+			timings = append(timings, entry)
+		}
+	}
+	for idx, timing := range timings {
+		if timing.sun != "" {
+			resolved, err := ctx.resolveSun(timing, current)
+			if err != nil {
+				return none, err
 			}
+			timing = resolved
 		}
-		lineTrack := newScheduleTime(hour, min, toggle)
-		timings = append(timings, lineTrack)
+		timings[idx].hour, timings[idx].min = clampDST(current, timing.hour, timing.min)
 	}
-	match := noAction
+	// stable so entries at the same minute keep schedule order, the later one winning
+	sort.SliceStable(timings, func(i, j int) bool {
+		return timings[i].minuteOfDay() < timings[j].minuteOfDay()
+	})
+	match := none
 	curr := newScheduleTime(current.Hour(), current.Minute(), "")
 	for _, timing := range timings {
-		if curr.min >= timing.min && curr.hour >= timing.hour {
-			match = timing.action
-		}
-		if match != noAction {
-			if curr.min < timing.min && curr.hour < timing.hour {
-				break
-			}
+		if timing.minuteOfDay() > curr.minuteOfDay() {
+			break
 		}
+		match = timing
 	}
 	return match, nil
 }
 
-func setYes(toggled bool) string {
+// nextChangeToday finds the first minute after now, on now's day, where the schedule resolves differently.
+func (ctx context) nextChangeToday(schedule string, now time.Time) (scheduleTime, scheduleTime, time.Time, bool, error) {
+	current, err := ctx.resolveScheduleAt(schedule, now)
+	if err != nil {
+		return current, current, time.Time{}, false, err
+	}
+	next, at, ok, err := ctx.changeOn(schedule, now.In(ctx.cfg.location).Truncate(time.Minute).Add(time.Minute), current)
+	return current, next, at, ok, err
+}
+
+// nextChange finds the next change of the stored schedules after now, looking up to a week ahead
+// using each day's own schedule.
+func (ctx context) nextChange(state *State, now time.Time) (scheduleTime, time.Time, bool, error) {
+	local := now.In(ctx.cfg.location)
+	current, err := ctx.resolveScheduleAt(state.scheduleFor(dayName(local.Weekday())), now)
+	if err != nil {
+		return current, time.Time{}, false, err
+	}
+	start := local.Truncate(time.Minute).Add(time.Minute)
+	for day := 0; day <= len(dayNames); day++ {
+		next, at, ok, err := ctx.changeOn(state.scheduleFor(dayName(start.Weekday())), start, current)
+		if err != nil || ok {
+			return next, at, ok, err
+		}
+		year, month, date := start.Date()
+		start = time.Date(year, month, date+1, 0, 0, 0, 0, ctx.cfg.location)
+	}
+	return current, time.Time{}, false, nil
+}
+
+// changeOn finds the first minute from start, on start's day, where the schedule resolves to an action different
+// to current. Each minute is resolved so ranges, sun times and DST are handled as the scheduler would.
+func (ctx context) changeOn(schedule string, start time.Time, current scheduleTime) (scheduleTime, time.Time, bool, error) {
+	for next := start; next.Day() == start.Day(); next = next.Add(time.Minute) {
+		timing, err := ctx.resolveScheduleAt(schedule, next)
+		if err != nil {
+			return timing, time.Time{}, false, err
+		}
+		if timing.action != noAction && (timing.action != current.action || timing.mode != current.mode) {
+			return timing, next, true, nil
+		}
+	}
+	return current, time.Time{}, false, nil
+}
+
+func (ctx context) preview(schedule string, now time.Time) (SchedulePreview, error) {
+	current, next, at, ok, err := ctx.nextChangeToday(schedule, now)
+	if err != nil {
+		return SchedulePreview{}, err
+	}
+	preview := SchedulePreview{Action: current.action, Mode: current.mode, Line: current.line, HasNext: ok}
+	if ok {
+		preview.NextTime = at
+		preview.NextAction = next.action
+		preview.NextMode = next.mode
+		preview.NextLine = next.line
+	}
+	return preview, nil
+}
+
+func setYes(toggled bool, labels string) string {
+	set, ok := labelSets[labels]
+	if !ok {
+		set = labelSets[""]
+	}
 	if toggled {
-		return "YES"
+		return set[0]
+	}
+	return set[1]
+}
+
+// authorized checks basic auth credentials, auth is off when no username is configured.
+func (c Configuration) authorized(r *http.Request) bool {
+	if c.Username == "" {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(c.Username)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(c.Password)) == 1
+	return userMatch && passwordMatch
+}
+
+// checkTLS requires the certificate and key be given together and exist.
+func (c Configuration) checkTLS() error {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		return nil
+	}
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return errors.New("both tlscert and tlskey must be set")
+	}
+	for _, file := range []string{c.TLSCert, c.TLSKey} {
+		if !pathExists(file) {
+			return fmt.Errorf("TLS file does not exist: %s", file)
+		}
+	}
+	return nil
+}
+
+func (c Configuration) checkLabels() error {
+	if _, ok := labelSets[c.Labels]; !ok {
+		return fmt.Errorf("unknown labels, must be yes-no, true-false or 1-0: %s", c.Labels)
 	}
-	return "NO"
+	return nil
 }
 
 func doTemplate(w http.ResponseWriter, tmpl *template.Template, obj Result) {
@@ -476,63 +2896,464 @@ func doTemplate(w http.ResponseWriter, tmpl *template.Template, obj Result) {
 	}
 }
 
+func newCapabilities() Capabilities {
+	return Capabilities{
+		Actions:   append(append([]string{}, writeActions...), readActions...),
+		ReadOnly:  readActions,
+		DayTypes:  []string{"*", everydayType, allDays, weekdayType, weekendType},
+		DayNames:  dayNames,
+		Baselines: []string{offAction, onAction, baselineNone},
+		Features:  scheduleFeatures,
+	}
+}
+
+func (ctx context) writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := ctx.marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		doTemplate(w, ctx.errorTemplate, Result{Error: fmt.Sprintf("%v", err)})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// isKnownAction reports whether an action is served.
+func isKnownAction(action string) bool {
+	for _, known := range append(readActions, writeActions...) {
+		if known == action {
+			return true
+		}
+	}
+	return false
+}
+
+func isWriteAction(action string) bool {
+	for _, write := range writeActions {
+		if write == action {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmed reports whether an action was confirmed by the interstitial page (or a script's header).
+func confirmed(r *http.Request) bool {
+	return r.Method == "POST" && (r.FormValue("confirm") == "yes" || r.Header.Get(confirmHeader) == "yes")
+}
+
+// writeError renders a failed request, a 400 for the client's errors, a 504 when it timed out, otherwise a 500.
+func (ctx context) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var failed *actionError
+	if errors.Is(r.Context().Err(), gocontext.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	} else if errors.As(err, &failed) {
+		status = failed.status
+	}
+	w.WriteHeader(status)
+	doTemplate(w, ctx.errorTemplate, Result{Error: fmt.Sprintf("%v", err)})
+}
+
 func doActionCall(w http.ResponseWriter, r *http.Request, ctx context) {
-	parts := strings.Split(r.URL.String(), "/")
-	if len(parts) != 3 {
-		logError("invalid action, not given", nil)
+	// actions may be nested, e.g. override/status, and any query or trailing slash is not part of them
+	path := ctx.cfg.actionPath()
+	if !strings.HasPrefix(r.URL.Path, path) {
+		logWarn("invalid action, not given", nil)
+		return
+	}
+	action := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, path), "/")
+	if action == "" {
+		action = ctx.cfg.DefaultAction
+	}
+	if !isKnownAction(action) {
+		http.Error(w, fmt.Sprintf("unknown action: %s", r.URL.Path), http.StatusNotFound)
 		return
 	}
-	action := parts[2]
 	isPost := r.Method == "POST"
+	// responses reflect the current state, only the display may opt into caching
+	w.Header().Set("Cache-Control", "no-store")
+	if timeout := ctx.cfg.actionTimeout(); timeout > 0 {
+		rctx, cancel := gocontext.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(rctx)
+	}
 	if action != isDisplay {
+		if action == onAction && ctx.cfg.ConfirmOn && !confirmed(r) {
+			state, err := ctx.getState()
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			doTemplate(w, ctx.confirmTemplate, Result{System: state.OpMode})
+			return
+		}
 		if action == "current" {
 			state, err := ctx.getState()
 			if err != nil {
-				doTemplate(w, ctx.errorTemplate, Result{Error: fmt.Sprintf("%v", err)})
+				ctx.writeError(w, r, err)
 				return
 			}
-			data := []byte(state.runningState())
+			data := []byte(state.runningState(ctx.cfg.Labels))
 			w.Write(data)
 			return
 		}
+		if action == "lastcommand" {
+			ctx.writeJSON(w, ctx.last.get())
+			return
+		}
+		if action == "trace" {
+			ctx.writeJSON(w, ctx.trace.get())
+			return
+		}
+		if action == "downloadstate" {
+			b, err := ctx.readStateFile()
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(ctx.stateFile)))
+			w.Write(b)
+			return
+		}
+		if !isPost && action == scheduleJSON {
+			state, err := ctx.getState()
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			day := r.URL.Query().Get("day")
+			if day == "" {
+				day = allDays
+			}
+			if day != allDays {
+				if _, err := parseDayName(day); err != nil {
+					ctx.writeError(w, r, invalidInput(err))
+					return
+				}
+			}
+			export, err := newScheduleExport(day, state.storedSchedule(day))
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			export.Token = scheduleToken(state.storedSchedule(day))
+			ctx.writeJSON(w, export)
+			return
+		}
+		if action == "preview" {
+			preview, err := ctx.preview(r.URL.Query().Get("sched"), time.Now())
+			if err != nil {
+				ctx.writeError(w, r, invalidInput(err))
+				return
+			}
+			ctx.writeJSON(w, preview)
+			return
+		}
+		if action == "report" {
+			state, err := ctx.getState()
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			ctx.writeJSON(w, runtimeReport(state.History, time.Now(), ctx.cfg.location))
+			return
+		}
+		if action == "status" {
+			state, err := ctx.getState()
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			ctx.writeJSON(w, Status{State: state, OpModes: ctx.remote.get().modes, Version: ctx.cfg.version})
+			return
+		}
+		if action == "history" {
+			count := historyLines
+			if lines := r.URL.Query().Get("lines"); lines != "" {
+				parsed, err := strconv.Atoi(lines)
+				if err != nil || parsed <= 0 {
+					ctx.writeError(w, r, invalidInput(fmt.Errorf("invalid history lines: %s", lines)))
+					return
+				}
+				count = parsed
+			}
+			history, err := ctx.readHistory(count)
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, line := range history {
+				fmt.Fprintln(w, line)
+			}
+			return
+		}
+		if action == "metrics" {
+			state, err := ctx.getState()
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.Write([]byte(ctx.metricsText(state)))
+			return
+		}
+		if action == overrideStatus {
+			state, err := ctx.getState()
+			if err != nil {
+				ctx.writeError(w, r, err)
+				return
+			}
+			ctx.writeJSON(w, ctx.overrideStatus(state, time.Now()))
+			return
+		}
+		if action == "capabilities" {
+			ctx.writeJSON(w, newCapabilities())
+			return
+		}
+		if action == "healthz" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if err := ctx.healthy(); err != nil {
+				logWarn("health check failed", err)
+				http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		if !isPost && ctx.cfg.GETMutationsDisabled && isWriteAction(action) {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, fmt.Sprintf("%s requires POST", action), http.StatusMethodNotAllowed)
+			return
+		}
 		if err := act(action, isPost, r, ctx); err != nil {
-			doTemplate(w, ctx.errorTemplate, Result{Error: fmt.Sprintf("%v", err)})
+			ctx.writeError(w, r, err)
 			return
 		}
 	}
 	if isPost {
-		http.Redirect(w, r, fmt.Sprintf("%s%s", endpoint, isDisplay), http.StatusSeeOther)
+		http.Redirect(w, r, ctx.cfg.link(isDisplay), http.StatusSeeOther)
 		return
 	}
 	result := Result{}
 	state, err := ctx.getState()
 	if err != nil {
-		doTemplate(w, ctx.errorTemplate, Result{Error: fmt.Sprintf("%v", err)})
+		ctx.writeError(w, r, err)
 		return
 	}
-	result.Override = setYes(state.Override)
-	result.Manual = setYes(state.Manual)
-	result.OperationModes = ctx.cfg.opModes
-	schedule := state.Schedule
+	result.Override = setYes(state.Override, ctx.cfg.Labels)
+	result.Manual = setYes(state.Manual, ctx.cfg.Labels)
+	result.Scheduled = setYes(state.ScheduleEnabled, ctx.cfg.Labels)
+	result.OperationModes = ctx.remote.get().modes
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		day = allDays
+	}
+	if day != allDays {
+		if _, err := parseDayName(day); err != nil {
+			ctx.writeError(w, r, invalidInput(err))
+			return
+		}
+	}
+	result.Day = day
+	result.Days = append([]string{allDays}, dayNames...)
+	schedule := state.storedSchedule(day)
 	result.Schedule = schedule
+	result.Token = scheduleToken(schedule)
+	if export, err := newScheduleExport(day, schedule); err == nil {
+		result.Entries = export.Entries
+		result.Default = export.Default
+	}
+	result.Base = ctx.cfg.link("")
+	result.Remote = ctx.cfg.remoteName
 	result.Build = ctx.cfg.version
+	result.NextMode = state.NextMode
+	if time.Now().Before(state.PausedUntil) {
+		result.Paused = state.PausedUntil.Format(timeFormat)
+	}
+	if state.ScheduleEnabled && !state.Manual {
+		next, at, ok, err := ctx.nextChange(state, time.Now())
+		if err != nil {
+			logWarn("unable to find the next schedule change", err)
+		} else if ok {
+			result.NextChange = fmt.Sprintf("%s at %s", next.action, at.Format("Mon 15:04"))
+			if next.mode != "" {
+				result.NextChange = fmt.Sprintf("%s (%s) at %s", next.action, next.mode, at.Format("Mon 15:04"))
+			}
+		}
+	}
+	// zero for state files written before it was tracked
+	if !state.LastChanged.IsZero() {
+		result.LastChanged = state.LastChanged.Format(timeFormat)
+	}
 	acMode := state.OpMode
 	result.System = acMode
+	if ctx.cfg.DisplayMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", ctx.cfg.DisplayMaxAge))
+		w.Header().Set("Expires", time.Now().Add(time.Duration(ctx.cfg.DisplayMaxAge)*time.Second).UTC().Format(http.TimeFormat))
+	}
 	doTemplate(w, ctx.pageTemplate, result)
 }
 
-func (s *State) runningState() string {
-	return fmt.Sprintf("%s (%s)", setYes(s.Running), time.Now().Format("2006-01-02T15:04:05"))
+// metricsText writes the state and counters in the Prometheus text exposition format.
+func (ctx context) metricsText(state *State) string {
+	var b strings.Builder
+	write := func(name, kind, help string, value uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	asNumber := func(set bool) uint64 {
+		if set {
+			return 1
+		}
+		return 0
+	}
+	write("wit_running", "gauge", "Whether the unit is running.", asNumber(state.Running))
+	write("wit_manual", "gauge", "Whether manual mode is set.", asNumber(state.Manual))
+	write("wit_override", "gauge", "Whether an override is active.", asNumber(state.Override))
+	write("wit_actuations_total", "counter", "IR commands sent.", atomic.LoadUint64(&ctx.metrics.actuations))
+	write("wit_scheduler_errors_total", "counter", "Failed scheduler runs.", atomic.LoadUint64(&ctx.metrics.schedulerErrors))
+	return b.String()
+}
+
+// overrideStatus reports the override, which the scheduler clears at midnight unless PersistOverride is set,
+// or sooner when it was given a timeout.
+func (ctx context) overrideStatus(state *State, now time.Time) OverrideStatus {
+	status := OverrideStatus{Active: state.Override}
+	if !state.Override {
+		return status
+	}
+	if !ctx.cfg.PersistOverride {
+		local := now.In(ctx.cfg.location)
+		midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, ctx.cfg.location)
+		status.ExpiresAt = &midnight
+	}
+	if until := state.OverrideUntil; !until.IsZero() && (status.ExpiresAt == nil || until.Before(*status.ExpiresAt)) {
+		status.ExpiresAt = &until
+	}
+	return status
+}
+
+// runtimeReport totals the on-time per local day from the first transition through now, days without any runtime report zero.
+func runtimeReport(history []Transition, now time.Time, loc *time.Location) []DayRuntime {
+	report := []DayRuntime{}
+	if len(history) == 0 {
+		return report
+	}
+	totals := make(map[string]time.Duration)
+	add := func(start, end time.Time) {
+		for start.Before(end) {
+			local := start.In(loc)
+			midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+			segment := end
+			if midnight.Before(end) {
+				segment = midnight
+			}
+			totals[local.Format(reportDateFormat)] += segment.Sub(start)
+			start = segment
+		}
+	}
+	var onSince time.Time
+	running := false
+	for _, transition := range history {
+		if transition.Running && !running {
+			onSince = transition.Time
+		}
+		if !transition.Running && running {
+			add(onSince, transition.Time)
+		}
+		running = transition.Running
+	}
+	if running {
+		add(onSince, now)
+	}
+	first := history[0].Time.In(loc)
+	last := now.In(loc).Format(reportDateFormat)
+	for day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc); ; day = day.AddDate(0, 0, 1) {
+		date := day.Format(reportDateFormat)
+		report = append(report, DayRuntime{Date: date, Seconds: int64(totals[date].Seconds())})
+		if date >= last {
+			break
+		}
+	}
+	return report
+}
+
+// scheduleFor is the day's own schedule, falling back to the all days schedule.
+func (s *State) scheduleFor(day string) string {
+	if schedule, ok := s.DaySchedules[day]; ok {
+		return schedule
+	}
+	return s.Schedule
+}
+
+// storedSchedule is the schedule saved for the day (or all days), without falling back.
+func (s *State) storedSchedule(day string) string {
+	if day == "" || day == allDays {
+		return s.Schedule
+	}
+	return s.DaySchedules[day]
+}
+
+// scheduleToken identifies a saved schedule so an edit of an older copy can be detected.
+func scheduleToken(schedule string) string {
+	sum := sha256.Sum256([]byte(schedule))
+	return hex.EncodeToString(sum[:8])
+}
+
+// checkScheduleToken rejects a schedule edit made from a copy that has since been changed.
+func (ctx context) checkScheduleToken(state *State, day, token string) error {
+	if token == "" && !ctx.cfg.RequireScheduleToken {
+		return nil
+	}
+	current := state.storedSchedule(day)
+	if token != scheduleToken(current) {
+		return &actionError{status: http.StatusConflict, err: fmt.Errorf("schedule was changed since it was loaded, current schedule:\n%s", current)}
+	}
+	return nil
+}
+
+// setSchedule saves the all days schedule or a day's own one, an empty day schedule falls back to all days.
+func (s *State) setSchedule(day, schedule string) error {
+	if day == "" || day == allDays {
+		s.Schedule = schedule
+		return nil
+	}
+	if _, err := parseDayName(day); err != nil {
+		return err
+	}
+	if schedule == "" {
+		delete(s.DaySchedules, day)
+		return nil
+	}
+	if s.DaySchedules == nil {
+		s.DaySchedules = make(map[string]string)
+	}
+	s.DaySchedules[day] = schedule
+	return nil
+}
+
+func (s *State) runningState(labels string) string {
+	return fmt.Sprintf("%s (%s)", setYes(s.Running, labels), time.Now().Format(timeFormat))
 }
 
-func runLIRCDaemon(args []string) {
+func runLIRCDaemon(args []string, timeout time.Duration) {
 	for {
-		cmd := exec.Command("lircd", args...)
+		runCtx, cancel := gocontext.Background(), func() {}
+		if timeout > 0 {
+			runCtx, cancel = gocontext.WithTimeout(runCtx, timeout)
+		}
+		cmd := exec.CommandContext(runCtx, "lircd", args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
+			if errors.Is(runCtx.Err(), gocontext.DeadlineExceeded) {
+				err = fmt.Errorf("lircd timed out after %s: %w", timeout, err)
+			}
 			logError("lircd failure", err)
 		}
+		cancel()
 		time.Sleep(30 * time.Second)
 	}
 }
@@ -542,36 +3363,174 @@ func (c *Configuration) runLIRC() {
 	args = append(args, c.LIRC.Args...)
 	args = append(args, []string{"-o", c.LIRC.Socket}...)
 	args = append(args, c.LIRC.Config)
-	go runLIRCDaemon(args)
+	go runLIRCDaemon(args, time.Duration(c.LIRC.DaemonTimeout)*time.Second)
+}
+
+func (c *configFiles) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *configFiles) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// readConfig reads the configuration files in order, later files only replace the fields they set.
+func readConfig(files configFiles) (*Configuration, error) {
+	config := &Configuration{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return config, nil
+}
+
+// reloadOn re-reads the lirc settings and LIRC configs on each signal and swaps in their modes, verbs,
+// suffixes and irsend, keeping the current ones when it fails. Everything else in the configuration,
+// including how lircd is started, needs a restart.
+func reloadOn(signals <-chan os.Signal, files configFiles, contexts []context) {
+	for range signals {
+		config, err := readConfig(files)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err == nil {
+			err = config.parseLIRCConfig()
+		}
+		if err != nil {
+			logError("unable to reload LIRC config, keeping current modes", err)
+			continue
+		}
+		for _, ctx := range contexts {
+			reloaded := *config
+			if name := ctx.cfg.remoteName; name != "" {
+				if _, ok := config.Remotes[name]; !ok {
+					logError("unable to reload LIRC config, keeping current modes", fmt.Errorf("remote %s was removed", name))
+					continue
+				}
+				reloaded, err = config.forRemote(name)
+				if err != nil {
+					logError("unable to reload LIRC config, keeping current modes", err)
+					continue
+				}
+			}
+			ctx.remote.set(reloaded)
+			logInfo(fmt.Sprintf("reloaded LIRC config %s, modes: %s", ctx.cfg.actionPath(), strings.Join(reloaded.opModes, ", ")))
+			if err := ctx.checkOpMode(); err != nil {
+				logError("unable to check the selected mode", err)
+			}
+		}
+	}
 }
 
 func main() {
-	configurationFile := flag.String("config", "/etc/wit.json", "wit configuration file")
+	var configurationFiles configFiles
+	flag.Var(&configurationFiles, "config", "wit configuration file (repeat to layer overrides, default /etc/wit.json)")
+	align := flag.Bool("align", false, "send start/stop codes slowly to aim the IR transmitter, then exit")
+	emitCron := flag.Bool("emit-cron", false, "print the stored schedule as crontab lines calling wit, then exit")
 	flag.Parse()
-	b, err := os.ReadFile(*configurationFile)
+	if len(configurationFiles) == 0 {
+		configurationFiles = configFiles{"/etc/wit.json"}
+	}
+	config, err := readConfig(configurationFiles)
 	if err != nil {
-		quit("unable to read config file", err)
+		quit("unable to read configuration", err)
 	}
-	config := &Configuration{}
-	if err := json.Unmarshal(b, &config); err != nil {
-		quit("failed to read config json", err)
+	if err := config.Validate(); err != nil {
+		quit("invalid configuration", err)
 	}
 	config.version = version
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		quit("invalid log level", err)
+	}
+	logLevel = level
+	config.location = time.Local
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			quit("invalid timezone", err)
+		}
+		config.location = location
+	}
+	if err := config.checkDefaultAction(); err != nil {
+		quit("invalid default action", err)
+	}
 	if err := config.parseLIRCConfig(); err != nil {
 		quit("unable to parse LIRC config", err)
 	}
+	if *align {
+		if config.LIRC.Daemon {
+			config.runLIRC()
+		}
+		if err := config.newContext().align(); err != nil {
+			quit("unable to complete alignment", err)
+		}
+		return
+	}
+	if *emitCron {
+		lines, err := config.newContext().cronLines()
+		if err != nil {
+			quit("unable to convert schedule to cron", err)
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return
+	}
 	mux := http.NewServeMux()
-	if err := config.setupServer(mux); err != nil {
+	stop, stopScheduler := gocontext.WithCancel(gocontext.Background())
+	contexts, stopped, err := config.setupServer(mux, stop)
+	if err != nil {
 		quit("failed to setup server", err)
 	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go reloadOn(hangups, configurationFiles, contexts)
 	srv := &http.Server{
 		Addr:    config.Binding,
 		Handler: mux,
 	}
-	if config.LIRC.Daemon {
-		config.runLIRC()
+	for _, ctx := range contexts {
+		if ctx.cfg.LIRC.Daemon {
+			ctx.cfg.runLIRC()
+		}
+	}
+	shutdown := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer close(shutdown)
+		sig := <-signals
+		logInfo(fmt.Sprintf("received %v, shutting down", sig))
+		stopScheduler()
+		timeout, cancel := gocontext.WithTimeout(gocontext.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(timeout); err != nil {
+			logError("unable to finish in-flight requests", err)
+		}
+	}()
+	listen := srv.ListenAndServe
+	if config.TLSCert != "" {
+		listen = func() error {
+			return srv.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		}
+	}
+	if err := listen(); err != nil {
+		if !errors.Is(err, http.ErrServerClosed) {
+			logError("listen and serve failed", err)
+			return
+		}
 	}
-	if err := srv.ListenAndServe(); err != nil {
-		logError("listen and serve failed", err)
+	<-shutdown
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		logWarn("scheduler did not stop in time", nil)
 	}
 }
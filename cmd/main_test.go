@@ -0,0 +1,2871 @@
+package main
+
+import (
+	"bufio"
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testLIRC = `begin remote
+  name testac
+  flags RAW_CODES
+  begin raw_codes
+    name coolSTART
+      100 200
+    name coolSTOP
+      100 200
+    name drySTART
+      100 200
+    name drySTOP
+      100 200
+  end raw_codes
+end remote
+`
+
+func TestMain(m *testing.M) {
+	logLevel = levelError + 1
+	os.Exit(m.Run())
+}
+
+// newTestContext is a context in a temporary cache whose irsend is a script logging its arguments,
+// configure may change the configuration before the LIRC config is parsed.
+func newTestContext(t *testing.T, configure func(*Configuration)) context {
+	t.Helper()
+	dir := t.TempDir()
+	lirc := filepath.Join(dir, "lircd.conf")
+	if err := os.WriteFile(lirc, []byte(testLIRC), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Configuration{
+		Binding:       ":7900",
+		Cache:         dir,
+		IRSendRetries: -1,
+		LIRC: LIRCConfiguration{
+			Socket: filepath.Join(dir, "lircd"),
+			Config: lirc,
+			IRSend: filepath.Join(dir, "irsend"),
+		},
+		location: time.UTC,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	if err := cfg.checkDefaultAction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.parseLIRCConfig(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := cfg.newContext()
+	fakeIRSend(t, ctx, "")
+	return ctx
+}
+
+// fakeIRSend replaces the irsend script, which logs its arguments and then runs body.
+func fakeIRSend(t *testing.T, ctx context, body string) {
+	t.Helper()
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\n%s\n", filepath.Join(ctx.cfg.Cache, "irsend.log"), body)
+	tmp := ctx.cfg.LIRC.IRSend + ".tmp"
+	if err := os.WriteFile(tmp, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, ctx.cfg.LIRC.IRSend); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sent is the arguments of each irsend call so far.
+func sent(t *testing.T, ctx context) []string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(ctx.cfg.Cache, "irsend.log"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// serve makes a request to the action handler, form values are posted when given.
+func serve(ctx context, method, target string, form url.Values) *httptest.ResponseRecorder {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	r := httptest.NewRequest(method, target, body)
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	doActionCall(w, r, ctx)
+	return w
+}
+
+func mustState(t *testing.T, ctx context) *State {
+	t.Helper()
+	state, err := ctx.getState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// newTestState is a fresh state with the cool mode selected.
+func newTestState() *State {
+	state := newState()
+	state.OpMode = "cool"
+	return state
+}
+
+func saveState(t *testing.T, ctx context, state *State) {
+	t.Helper()
+	if err := ctx.setState(state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	for _, pretty := range []bool{false, true} {
+		ctx := newTestContext(t, func(c *Configuration) {
+			c.PrettyJSON = pretty
+		})
+		saveState(t, ctx, newTestState())
+		b, err := os.ReadFile(ctx.stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if indented := strings.Contains(string(b), "\n    \"OpMode\""); indented != pretty {
+			t.Errorf("state file indented %t with pretty %t: %s", indented, pretty, b)
+		}
+		body := serve(ctx, http.MethodGet, "/wit/capabilities", nil).Body.String()
+		if indented := strings.Contains(body, "\n    \"actions\""); indented != pretty {
+			t.Errorf("response indented %t with pretty %t: %s", indented, pretty, body)
+		}
+	}
+}
+
+func TestScheduleDisabled(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 0 weekday on\n0 0 weekend on"
+	state.ScheduleEnabled = false
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if trace := ctx.trace.get(); trace.Reason != "schedule disabled" {
+		t.Errorf("schedule not skipped: %+v", trace)
+	}
+	if mustState(t, ctx).Running || len(sent(t, ctx)) != 0 {
+		t.Fatal("disabled schedule actuated")
+	}
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	state = mustState(t, ctx)
+	if !state.Running || state.Override {
+		t.Errorf("manual on: running %t, override %t", state.Running, state.Override)
+	}
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	if mustState(t, ctx).Running {
+		t.Error("manual off did not actuate")
+	}
+	if calls := sent(t, ctx); len(calls) != 2 {
+		t.Errorf("unexpected irsend calls: %v", calls)
+	}
+}
+
+// captureLogs is what is logged at level or above while fn runs.
+func captureLogs(t *testing.T, level int, fn func()) string {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout, stderr, previous := os.Stdout, os.Stderr, logLevel
+	os.Stdout, os.Stderr, logLevel = out, out, level
+	defer func() {
+		os.Stdout, os.Stderr, logLevel = stdout, stderr, previous
+	}()
+	fn()
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestThrottledLog(t *testing.T) {
+	failure := errors.New("irsend: hardware does not support sending")
+	output := captureLogs(t, levelDebug, func() {
+		failures := newThrottledLog("scheduler failed", time.Hour)
+		for i := 0; i < 120; i++ {
+			failures.log(failure)
+		}
+		failures.window = 0
+		failures.log(failure)
+		failures.reset()
+	})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("failures not throttled: %q", lines)
+	}
+	if !strings.Contains(lines[1], "scheduler failed 120 times in the last") {
+		t.Errorf("unexpected summary: %s", lines[1])
+	}
+}
+
+func TestScheduleRangeAcrossMidnight(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	schedule := "22:00-06:00 everyday on"
+	for _, test := range []struct {
+		hour   int
+		action string
+	}{
+		{21, offAction},
+		{22, onAction},
+		{23, onAction},
+		{3, onAction},
+		{6, offAction},
+		{7, offAction},
+	} {
+		now := time.Date(2024, time.January, 3, test.hour, 0, 0, 0, time.UTC)
+		action, err := ctx.parseScheduleAt(schedule, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != test.action {
+			t.Errorf("%02d:00: got %q, want %q", test.hour, action, test.action)
+		}
+	}
+}
+
+func TestScheduleJSONBody(t *testing.T) {
+	schedule := "0 7 weekday on\n0 22 weekday off"
+	form := newTestContext(t, nil)
+	saveState(t, form, newTestState())
+	if w := serve(form, http.MethodPost, "/wit/schedule", url.Values{"opmode": {"dry"}, "manual": {"on"}, "sched": {schedule}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("form schedule failed: %d %s", w.Code, w.Body)
+	}
+	api := newTestContext(t, nil)
+	saveState(t, api, newTestState())
+	body := `{"opmode":"dry","manual":true,"sched":"0 7 weekday on\n0 22 weekday off"}`
+	r := httptest.NewRequest(http.MethodPost, "/wit/schedule", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w := httptest.NewRecorder()
+	doActionCall(w, r, api)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("json schedule failed: %d %s", w.Code, w.Body)
+	}
+	expected, actual := mustState(t, form), mustState(t, api)
+	if actual.Schedule != schedule || actual.OpMode != "dry" || !actual.Manual {
+		t.Errorf("json schedule not saved: %+v", actual)
+	}
+	if actual.Schedule != expected.Schedule || actual.OpMode != expected.OpMode || actual.Manual != expected.Manual {
+		t.Errorf("json and form differ: %+v %+v", actual, expected)
+	}
+}
+
+func TestSetMode(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 7 weekday on"
+	state.Manual = true
+	saveState(t, ctx, state)
+	serve(ctx, http.MethodPost, "/wit/setmode", url.Values{"mode": {"dry"}})
+	state = mustState(t, ctx)
+	if state.OpMode != "dry" || state.Schedule != "0 7 weekday on" || !state.Manual {
+		t.Errorf("setmode changed more than the mode: %+v", state)
+	}
+	if calls := sent(t, ctx); len(calls) != 0 {
+		t.Errorf("setmode actuated while off: %v", calls)
+	}
+	state.Running = true
+	state.RunningMode = "dry"
+	saveState(t, ctx, state)
+	serve(ctx, http.MethodPost, "/wit/setmode", url.Values{"mode": {"cool"}})
+	state = mustState(t, ctx)
+	if state.OpMode != "cool" || state.RunningMode != "cool" {
+		t.Errorf("setmode while running: %+v", state)
+	}
+	if calls := sent(t, ctx); len(calls) != 1 || !strings.HasSuffix(calls[0], "SEND_ONCE testac coolSTART") {
+		t.Errorf("setmode did not re-actuate: %v", calls)
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/setmode", url.Values{"mode": {"heat"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode accepted: %d", w.Code)
+	}
+}
+
+func TestReadConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.json")
+	host := filepath.Join(dir, "host.json")
+	if err := os.WriteFile(base, []byte(`{"binding": ":7801", "cache": "/var/cache/wit", "pollinterval": 10, "lirc": {"socket": "/run/lirc/lircd", "irsend": "/usr/bin/irsend"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(host, []byte(`{"binding": ":7802", "lirc": {"socket": "/run/lirc/lircd-tx"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var files configFiles
+	for _, file := range []string{base, host} {
+		if err := files.Set(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, err := readConfig(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Binding != ":7802" || config.LIRC.Socket != "/run/lirc/lircd-tx" {
+		t.Errorf("override not applied: %+v", config)
+	}
+	if config.Cache != "/var/cache/wit" || config.PollInterval != 10 || config.LIRC.IRSend != "/usr/bin/irsend" {
+		t.Errorf("omitted fields clobbered: %+v", config)
+	}
+	if _, err := readConfig(configFiles{base, filepath.Join(dir, "missing.json")}); err == nil {
+		t.Error("missing config file was not an error")
+	}
+}
+
+func TestAlign(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Running = true
+	state.RunningMode = "cool"
+	saveState(t, ctx, state)
+	delay := alignDelay
+	alignDelay = time.Millisecond
+	defer func() {
+		alignDelay = delay
+	}()
+	if err := ctx.align(); err != nil {
+		t.Fatal(err)
+	}
+	calls := sent(t, ctx)
+	if len(calls) != 2*alignCycles {
+		t.Fatalf("unexpected irsend calls: %v", calls)
+	}
+	for idx, call := range calls {
+		code := "coolSTART"
+		if idx%2 == 1 {
+			code = "coolSTOP"
+		}
+		if !strings.HasSuffix(call, "SEND_ONCE testac "+code) {
+			t.Errorf("send %d is not %s: %s", idx, code, call)
+		}
+	}
+	if mustState(t, ctx).Running {
+		t.Error("align did not leave the unit off")
+	}
+}
+
+func TestModeMap(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.LIRC.ModeMap = map[string]string{"chill": "cool", "dehumidify": "dry"}
+	})
+	if modes := ctx.remote.get().modes; strings.Join(modes, ",") != "chill,dehumidify" {
+		t.Errorf("modes are not canonical: %v", modes)
+	}
+	state := newState()
+	state.OpMode = "chill"
+	saveState(t, ctx, state)
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if calls := sent(t, ctx); len(calls) != 1 || !strings.HasSuffix(calls[0], "SEND_ONCE testac coolSTART") {
+		t.Errorf("canonical mode not mapped: %v", calls)
+	}
+	if state := mustState(t, ctx); state.OpMode != "chill" || state.RunningMode != "chill" {
+		t.Errorf("stored mode is not canonical: %+v", state)
+	}
+}
+
+func TestReload(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	file := filepath.Join(t.TempDir(), "wit.json")
+	reload := func(lirc LIRCConfiguration) {
+		t.Helper()
+		cfg := ctx.cfg
+		cfg.LIRC = lirc
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		signals := make(chan os.Signal, 1)
+		signals <- syscall.SIGHUP
+		close(signals)
+		reloadOn(signals, configFiles{file}, []context{ctx})
+	}
+	lirc := ctx.cfg.LIRC
+	lirc.Config = writeLIRC(t, "testac", "coolON", "coolOFF", "fanON", "fanOFF")
+	lirc.StartSuffix = "ON"
+	lirc.StopSuffix = "OFF"
+	lirc.StartVerb = "SEND_START"
+	reload(lirc)
+	if modes := ctx.remote.get().modes; strings.Join(modes, ",") != "cool,fan" {
+		t.Errorf("modes not reloaded: %v", modes)
+	}
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if calls := sent(t, ctx); len(calls) != 1 || !strings.HasSuffix(calls[0], "SEND_START testac coolON") {
+		t.Errorf("verb and suffix not reloaded: %v", calls)
+	}
+	broken := lirc
+	broken.Config = writeLIRC(t, "testac", "heatSTART", "heatSTOP")
+	broken.SendVerb = "SHOUT"
+	reload(broken)
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	if calls := sent(t, ctx); len(calls) != 2 || !strings.HasSuffix(calls[1], "SEND_ONCE testac coolOFF") {
+		t.Errorf("failed reload not kept the current settings: %v", calls)
+	}
+}
+
+func TestLastCommand(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	if body := serve(ctx, http.MethodGet, "/wit/lastcommand", nil).Body.String(); body != "null" {
+		t.Errorf("last command before any actuation: %s", body)
+	}
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	command := Command{}
+	if err := json.Unmarshal(serve(ctx, http.MethodGet, "/wit/lastcommand", nil).Body.Bytes(), &command); err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(command.Args, " ")
+	if command.ExitCode != 0 || !strings.Contains(args, "--device="+ctx.cfg.LIRC.Socket) || !strings.HasSuffix(args, "testac coolSTART") {
+		t.Errorf("unexpected last command: %+v", command)
+	}
+	fakeIRSend(t, ctx, "exit 3")
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	command = Command{}
+	if err := json.Unmarshal(serve(ctx, http.MethodGet, "/wit/lastcommand", nil).Body.Bytes(), &command); err != nil {
+		t.Fatal(err)
+	}
+	if command.ExitCode != 3 || command.Error == "" || !strings.HasSuffix(strings.Join(command.Args, " "), "testac coolSTOP") {
+		t.Errorf("failed command not reported: %+v", command)
+	}
+}
+
+func TestScheduleFormWithoutSched(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 7 everyday on"
+	saveState(t, ctx, state)
+	serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"opmode": {"dry"}})
+	state = mustState(t, ctx)
+	if state.Schedule != "0 7 everyday on" || state.OpMode != "dry" {
+		t.Errorf("schedule not preserved: %+v", state)
+	}
+	serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"opmode": {"dry"}, "sched": {""}})
+	if state := mustState(t, ctx); state.Schedule != "" {
+		t.Errorf("empty schedule not saved: %+v", state)
+	}
+}
+
+// newTestServer is the server's mux for the configuration, its schedulers are stopped when the test ends.
+func newTestServer(t *testing.T, cfg Configuration) *http.ServeMux {
+	t.Helper()
+	mux := http.NewServeMux()
+	stop, cancel := gocontext.WithCancel(gocontext.Background())
+	_, stopped, err := cfg.setupServer(mux, stop)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return mux
+}
+
+func TestFavicon(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	mux := newTestServer(t, ctx.cfg)
+	var w *httptest.ResponseRecorder
+	output := captureLogs(t, levelDebug, func() {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/x-icon" || w.Body.Len() != len(favicon) {
+		t.Errorf("favicon not served: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if strings.Contains(output, "invalid action") {
+		t.Errorf("favicon logged as an action: %s", output)
+	}
+	static := t.TempDir()
+	if err := os.WriteFile(filepath.Join(static, "style.css"), []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := ctx.cfg
+	cfg.Static = static
+	w = httptest.NewRecorder()
+	newTestServer(t, cfg).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/style.css", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "body {}" {
+		t.Errorf("static file not served: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestNextMode(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	serve(ctx, http.MethodPost, "/wit/nextmode", url.Values{"mode": {"dry"}})
+	if state := mustState(t, ctx); state.NextMode != "dry" || state.OpMode != "cool" {
+		t.Fatalf("next mode not stored: %+v", state)
+	}
+	for _, action := range []string{onAction, offAction, onAction} {
+		if err := act(action, true, nil, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := sent(t, ctx)
+	want := []string{"drySTART", "drySTOP", "coolSTART"}
+	if len(calls) != len(want) {
+		t.Fatalf("unexpected irsend calls: %v", calls)
+	}
+	for idx, code := range want {
+		if !strings.HasSuffix(calls[idx], code) {
+			t.Errorf("send %d is not %s: %s", idx, code, calls[idx])
+		}
+	}
+	if state := mustState(t, ctx); state.NextMode != "" {
+		t.Errorf("next mode not cleared: %+v", state)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	schedule := "0 9 everyday off\n0 18 everyday on"
+	early := time.Date(2024, time.January, 3, 6, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		baseline string
+		action   string
+	}{
+		{"", offAction},
+		{offAction, offAction},
+		{onAction, onAction},
+		{baselineNone, noAction},
+	} {
+		ctx := newTestContext(t, func(c *Configuration) {
+			c.Baseline = test.baseline
+		})
+		action, err := ctx.parseScheduleAt(schedule, early)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != test.action {
+			t.Errorf("baseline %q: got %q, want %q", test.baseline, action, test.action)
+		}
+	}
+	if _, err := (Configuration{Baseline: "maybe"}).baseline(); err == nil {
+		t.Error("invalid baseline accepted")
+	}
+}
+
+func TestMatchesDayRanges(t *testing.T) {
+	for _, test := range []struct {
+		dayType string
+		day     time.Weekday
+		matched bool
+	}{
+		{"mon-fri", time.Wednesday, true},
+		{"mon-fri", time.Saturday, false},
+		{"sat-sun", time.Sunday, true},
+		{"sat-sun", time.Friday, false},
+		{"mon-thu", time.Friday, false},
+		{"wed", time.Wednesday, true},
+		{weekdayType, time.Monday, true},
+		{weekendType, time.Saturday, true},
+		{everydayType, time.Sunday, true},
+	} {
+		matched, err := matchesDay(test.dayType, test.day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != test.matched {
+			t.Errorf("%s on %s: got %t, want %t", test.dayType, test.day, matched, test.matched)
+		}
+	}
+	for _, invalid := range []string{"fri-mon", "mon-funday", "saturday"} {
+		if _, err := matchesDay(invalid, time.Monday); err == nil {
+			t.Errorf("invalid day type accepted: %s", invalid)
+		}
+	}
+}
+
+func TestDefaultAction(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.DefaultAction = "current"
+	})
+	state := newTestState()
+	state.Running = true
+	saveState(t, ctx, state)
+	if body := serve(ctx, http.MethodGet, "/wit/", nil).Body.String(); !strings.HasPrefix(body, "YES (") {
+		t.Errorf("default action not used: %s", body)
+	}
+	if body := serve(ctx, http.MethodGet, "/wit/display", nil).Body.String(); !strings.Contains(body, "<html") {
+		t.Errorf("display not rendered: %s", body)
+	}
+	for _, action := range []string{onAction, "reset", "bogus"} {
+		cfg := Configuration{DefaultAction: action}
+		if err := cfg.checkDefaultAction(); err == nil {
+			t.Errorf("default action accepted: %s", action)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	level, err := parseLogLevel("warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := captureLogs(t, level, func() {
+		logDebug("tick details")
+		logInfo("scheduler started")
+		logWarn("state pipe busy", nil)
+		logError("scheduler failed", errors.New("irsend failed"))
+	})
+	if strings.Contains(output, "tick details") || strings.Contains(output, "scheduler started") {
+		t.Errorf("messages below warn were written: %s", output)
+	}
+	if !strings.Contains(output, "[warn] state pipe busy\n") || !strings.Contains(output, "[error] scheduler failed (irsend failed)\n") {
+		t.Errorf("messages at or above warn were not written: %s", output)
+	}
+	if level, err := parseLogLevel(""); err != nil || level != levelInfo {
+		t.Errorf("default level is not info: %d %v", level, err)
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestReset(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	dirty := func() {
+		state := newTestState()
+		state.Running = true
+		state.Manual = true
+		state.Override = true
+		state.OpMode = "dry"
+		state.Schedule = "0 7 weekday on"
+		saveState(t, ctx, state)
+	}
+	dirty()
+	if w := serve(ctx, http.MethodPost, "/wit/reset", url.Values{}); w.Code != http.StatusBadRequest {
+		t.Errorf("reset without confirmation: %d", w.Code)
+	}
+	if !mustState(t, ctx).Running {
+		t.Fatal("unconfirmed reset changed the state")
+	}
+	serve(ctx, http.MethodPost, "/wit/reset", url.Values{"confirm": {"yes"}})
+	state := mustState(t, ctx)
+	if state.Running || state.Manual || state.Override || state.OpMode != "" || state.Schedule != "" {
+		t.Errorf("state not reset: %+v", state)
+	}
+	dirty()
+	serve(ctx, http.MethodPost, "/wit/reset", url.Values{"confirm": {"yes"}, "keep": {"schedule"}})
+	state = mustState(t, ctx)
+	if state.Running || state.Manual || state.Override || state.OpMode != "" || state.Schedule != "0 7 weekday on" {
+		t.Errorf("state not reset keeping the schedule: %+v", state)
+	}
+	cfg := ctx.cfg
+	cfg.Username = "admin"
+	cfg.Password = "secret"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/wit/reset", strings.NewReader("confirm=yes"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	newTestServer(t, cfg).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("reset without credentials: %d", w.Code)
+	}
+}
+
+func TestSendVerb(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.LIRC.SendVerb = "SEND_MACRO"
+	})
+	saveState(t, ctx, newTestState())
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if calls := sent(t, ctx); len(calls) != 1 || !strings.HasSuffix(calls[0], "SEND_MACRO testac coolSTART") {
+		t.Errorf("send verb not used: %v", calls)
+	}
+	if err := (LIRCConfiguration{SendVerb: "SEND_TWICE"}).checkVerbs(); err == nil {
+		t.Error("unknown send verb accepted")
+	}
+}
+
+func TestActionTimeout(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.ActionTimeout = 1
+	})
+	saveState(t, ctx, newTestState())
+	fakeIRSend(t, ctx, "exec sleep 10")
+	start := time.Now()
+	w := serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow actuation status: %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("request was not bounded by the deadline: %s", elapsed)
+	}
+	if mustState(t, ctx).Running {
+		t.Error("timed out actuation changed the state")
+	}
+}
+
+func TestScheduleVariables(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	schedule := "@morning = 0 7\n@morning weekday on\n@morning weekend off\n0 22 everyday off"
+	lines, err := expandScheduleVariables(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lines, "|"); !strings.Contains(got, "0 7 weekday on|0 7 weekend off") {
+		t.Errorf("variable not expanded: %q", lines)
+	}
+	wednesday := time.Date(2024, time.January, 3, 8, 0, 0, 0, time.UTC)
+	saturday := time.Date(2024, time.January, 6, 8, 0, 0, 0, time.UTC)
+	if action, err := ctx.parseScheduleAt(schedule, wednesday); err != nil || action != onAction {
+		t.Errorf("weekday at 08:00: %q %v", action, err)
+	}
+	if action, err := ctx.parseScheduleAt(schedule, saturday); err != nil || action != offAction {
+		t.Errorf("weekend at 08:00: %q %v", action, err)
+	}
+	if _, err := ctx.parseSchedule("@evening weekday on"); err == nil || !strings.Contains(err.Error(), "@evening") {
+		t.Errorf("undefined variable: %v", err)
+	}
+}
+
+func TestReactuate(t *testing.T) {
+	for _, reactuate := range []bool{false, true} {
+		ctx := newTestContext(t, func(c *Configuration) {
+			c.Reactuate = reactuate
+		})
+		state := newTestState()
+		state.Running = true
+		state.RunningMode = "cool"
+		saveState(t, ctx, state)
+		serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"opmode": {"dry"}})
+		state = mustState(t, ctx)
+		calls := sent(t, ctx)
+		if !reactuate {
+			if len(calls) != 0 || state.RunningMode != "cool" {
+				t.Errorf("re-actuated when not configured: %v %+v", calls, state)
+			}
+			continue
+		}
+		if len(calls) != 1 || !strings.HasSuffix(calls[0], "SEND_ONCE testac drySTART") {
+			t.Errorf("new mode not sent: %v", calls)
+		}
+		if !state.Running || state.RunningMode != "dry" || state.OpMode != "dry" {
+			t.Errorf("running mode not updated: %+v", state)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	w := serve(ctx, http.MethodGet, "/wit/capabilities", nil)
+	capabilities := Capabilities{}
+	if err := json.Unmarshal(w.Body.Bytes(), &capabilities); err != nil {
+		t.Fatal(err)
+	}
+	contains := func(list []string, want string) bool {
+		for _, item := range list {
+			if item == want {
+				return true
+			}
+		}
+		return false
+	}
+	for _, day := range []string{weekdayType, weekendType, everydayType} {
+		if !contains(capabilities.DayTypes, day) {
+			t.Errorf("day type missing: %s", day)
+		}
+	}
+	for _, day := range capabilities.DayTypes {
+		if _, err := matchesDay(day, time.Monday); err != nil {
+			t.Errorf("listed day type not accepted: %s", day)
+		}
+	}
+	for _, action := range []string{onAction, offAction, "calibrate", "togglelock", "schedule", "current", isDisplay} {
+		if !contains(capabilities.Actions, action) {
+			t.Errorf("action missing: %s", action)
+		}
+	}
+	for _, action := range capabilities.Actions {
+		if !isKnownAction(action) {
+			t.Errorf("listed action not served: %s", action)
+		}
+	}
+	if contains(capabilities.ReadOnly, onAction) {
+		t.Error("on listed as read only")
+	}
+}
+
+func TestMigrateVersionZero(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	if err := os.WriteFile(ctx.stateFile, []byte(`{"OpMode":"dry","Running":true,"Schedule":"0 7 * on"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := mustState(t, ctx)
+	if state.SchemaVersion != len(stateMigrations) {
+		t.Errorf("not migrated to the current version: %d", state.SchemaVersion)
+	}
+	if state.RunningMode != "dry" || !state.ScheduleEnabled || state.Schedule != "0 7 * on" {
+		t.Errorf("migrated state lacks defaults: %+v", state)
+	}
+	saveState(t, ctx, state)
+	if again := mustState(t, ctx); again.SchemaVersion != len(stateMigrations) || again.RunningMode != "dry" {
+		t.Errorf("migrated state not kept: %+v", again)
+	}
+}
+
+func TestPause(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 0 * on"
+	saveState(t, ctx, state)
+	if w := serve(ctx, http.MethodPost, "/wit/pause", url.Values{"duration": {"-1h"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("negative pause accepted: %d", w.Code)
+	}
+	serve(ctx, http.MethodPost, "/wit/pause", url.Values{"duration": {"1h"}})
+	state = mustState(t, ctx)
+	if until := time.Until(state.PausedUntil); until < 59*time.Minute || until > time.Hour {
+		t.Fatalf("pause not recorded: %s", state.PausedUntil)
+	}
+	if body := serve(ctx, http.MethodGet, "/wit/display", nil).Body.String(); !strings.Contains(body, state.PausedUntil.Format(timeFormat)) {
+		t.Error("pause not shown on the display")
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if trace := ctx.trace.get(); trace.Reason != "paused" || mustState(t, ctx).Running {
+		t.Errorf("schedule ran while paused: %+v", trace)
+	}
+	state.PausedUntil = time.Now().Add(-time.Second)
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("schedule did not resume after the pause")
+	}
+}
+
+func TestScheduleDST(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.location = location
+	})
+	schedule := "30 2 everyday on"
+	// 2024-03-10 skips from 02:00 to 03:00
+	for _, test := range []struct {
+		now    time.Time
+		action string
+	}{
+		{time.Date(2024, time.March, 10, 1, 59, 0, 0, location), offAction},
+		{time.Date(2024, time.March, 10, 3, 0, 0, 0, location), onAction},
+		{time.Date(2024, time.March, 11, 2, 29, 0, 0, location), offAction},
+		{time.Date(2024, time.March, 11, 2, 30, 0, 0, location), onAction},
+	} {
+		action, err := ctx.parseScheduleAt(schedule, test.now.UTC())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != test.action {
+			t.Errorf("%s: got %q, want %q", test.now, action, test.action)
+		}
+	}
+}
+
+func TestConfirmOn(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.ConfirmOn = true
+	})
+	saveState(t, ctx, newTestState())
+	w := serve(ctx, http.MethodGet, "/wit/on", nil)
+	if body := w.Body.String(); !strings.Contains(body, "Confirm ON (cool)") || !strings.Contains(body, "action='/wit/on'") {
+		t.Errorf("confirm page not rendered: %s", body)
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{}); w.Code != http.StatusOK || mustState(t, ctx).Running {
+		t.Errorf("unconfirmed post actuated: %d", w.Code)
+	}
+	if len(sent(t, ctx)) != 0 {
+		t.Fatal("confirm page actuated")
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{"confirm": {"yes"}}); w.Code != http.StatusSeeOther || !mustState(t, ctx).Running {
+		t.Errorf("confirmed post did not actuate: %d", w.Code)
+	}
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	r := httptest.NewRequest(http.MethodPost, "/wit/on", nil)
+	r.Header.Set(confirmHeader, "yes")
+	doActionCall(httptest.NewRecorder(), r, ctx)
+	if !mustState(t, ctx).Running {
+		t.Error("confirm header did not bypass the page")
+	}
+	if calls := sent(t, ctx); len(calls) != 3 {
+		t.Errorf("unexpected irsend calls: %v", calls)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 0 * on"
+	state.Override = true
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	trace := Trace{}
+	if err := json.Unmarshal(serve(ctx, http.MethodGet, "/wit/trace", nil).Body.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	if trace.Line != "0 0 * on" || trace.Action != onAction || trace.Outcome != outcomeSuppressed || trace.Reason != "override" {
+		t.Errorf("unexpected override trace: %+v", trace)
+	}
+	state.Override = false
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if trace := ctx.trace.get(); trace.Outcome != outcomeActuated || trace.Reason != "" {
+		t.Errorf("unexpected actuated trace: %+v", trace)
+	}
+}
+
+func TestCheckStateDir(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "missing", "nested", "state.json")
+	if err := (Configuration{}).checkStateDir(stateFile); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("missing directory: %v", err)
+	}
+	if err := (Configuration{CreateStateDir: true}).checkStateDir(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if !pathExists(filepath.Dir(stateFile)) {
+		t.Error("state directory not created")
+	}
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.StateFile = stateFile
+	})
+	saveState(t, ctx, newTestState())
+	if !pathExists(stateFile) {
+		t.Error("state not written outside the cache")
+	}
+}
+
+func TestParseTOMLLIRC(t *testing.T) {
+	classic := newTestContext(t, nil)
+	toml := newTestContext(t, func(c *Configuration) {
+		c.LIRC.Format = lircTOML
+		c.LIRC.Config = filepath.Join(c.Cache, "remote.toml")
+		data := "# converted from lircd.conf\n[remote]\nname = \"testac\"\n\n[codes]\ncoolSTART = \"100 200\"\ncoolSTOP = \"100 200\"\ndrySTART = \"100 200\"\ndrySTOP = \"100 200\"\n"
+		if err := os.WriteFile(c.LIRC.Config, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if toml.cfg.lircName != classic.cfg.lircName || strings.Join(toml.cfg.opModes, ",") != strings.Join(classic.cfg.opModes, ",") {
+		t.Errorf("toml parsed differently: %s %v, classic %s %v", toml.cfg.lircName, toml.cfg.opModes, classic.cfg.lircName, classic.cfg.opModes)
+	}
+	if _, _, err := parseTOMLLIRC("[codes]\ncoolSTART\n"); err == nil {
+		t.Error("invalid toml line accepted")
+	}
+	cfg := classic.cfg
+	cfg.LIRC.Format = "yaml"
+	if err := cfg.parseLIRCConfig(); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+// writeLIRC writes a classic LIRC config for the remote with the given raw code names.
+func writeLIRC(t *testing.T, name string, codes ...string) string {
+	t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "begin remote\n  name %s\n  begin raw_codes\n", name)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "    name %s\n      100 200\n", code)
+	}
+	b.WriteString("  end raw_codes\nend remote\n")
+	path := filepath.Join(t.TempDir(), "lircd.conf")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMaxModes(t *testing.T) {
+	var codes []string
+	for idx := 0; idx < 5; idx++ {
+		codes = append(codes, fmt.Sprintf("mode%dSTART", idx), fmt.Sprintf("mode%dSTOP", idx))
+	}
+	cfg := Configuration{LIRC: LIRCConfiguration{Config: writeLIRC(t, "testac", codes...)}}
+	if err := cfg.parseLIRCConfig(); err != nil || len(cfg.opModes) != 5 {
+		t.Fatalf("modes within the default limit: %v %v", cfg.opModes, err)
+	}
+	cfg.MaxModes = 4
+	if err := cfg.parseLIRCConfig(); err == nil || !strings.Contains(err.Error(), "too many modes (5), at most 4") {
+		t.Errorf("too many modes: %v", err)
+	}
+}
+
+func TestRemotes(t *testing.T) {
+	ctx := newTestContext(t, func(cfg *Configuration) {
+		cfg.Remotes = map[string]LIRCConfiguration{"bedroom": {
+			Socket: filepath.Join(cfg.Cache, "bedroom.lircd"),
+			Config: writeLIRC(t, "bedac", "heatSTART", "heatSTOP"),
+			IRSend: filepath.Join(t.TempDir(), "irsend"),
+		}}
+	})
+	saveState(t, ctx, newTestState())
+	bedroom, err := ctx.cfg.forRemote("bedroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeIRSend(t, context{cfg: bedroom}, "")
+	mux := newTestServer(t, ctx.cfg)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/wit/bedroom/on", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("remote on: %d %s", w.Code, w.Body.String())
+	}
+	if calls := sent(t, context{cfg: bedroom}); len(calls) != 1 || !strings.HasSuffix(calls[0], "SEND_ONCE bedac heatSTART") {
+		t.Errorf("remote on not sent to its own remote: %v", calls)
+	}
+	if calls := sent(t, ctx); len(calls) != 0 {
+		t.Errorf("remote on sent to the main remote: %v", calls)
+	}
+	if mustState(t, ctx).Running {
+		t.Error("remote on changed the main state")
+	}
+	remote := bedroom.newContext()
+	if remote.stateFile == ctx.stateFile || !mustState(t, remote).Running {
+		t.Errorf("remote state not kept in its own file: %s", remote.stateFile)
+	}
+	for _, name := range []string{"on", "override", "bed room"} {
+		cfg := ctx.cfg
+		cfg.Remotes = map[string]LIRCConfiguration{name: cfg.Remotes["bedroom"]}
+		if _, err := cfg.remoteConfigs(); err == nil {
+			t.Errorf("remote name %q accepted", name)
+		}
+	}
+}
+
+func TestStateCache(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	info, err := os.Stat(ctx.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(ctx.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same size and mtime, only a read from disk would see it
+	swapped := strings.Replace(string(original), `"OpMode":"cool"`, `"OpMode":"warm"`, 1)
+	if err := os.WriteFile(ctx.stateFile, []byte(swapped), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(ctx.stateFile, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 3; idx++ {
+		if state := mustState(t, ctx); state.OpMode != "cool" {
+			t.Fatalf("state read from disk instead of the cache: %+v", state)
+		}
+	}
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(ctx.stateFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if state := mustState(t, ctx); state.OpMode != "warm" {
+		t.Errorf("external edit not seen: %+v", state)
+	}
+}
+
+func TestDownloadState(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 7 * on"
+	state.Running = true
+	saveState(t, ctx, state)
+	w := serve(ctx, http.MethodGet, "/wit/downloadstate", nil)
+	if w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Content-Disposition") != `attachment; filename="state.json"` {
+		t.Errorf("unexpected headers: %v", w.Header())
+	}
+	downloaded := State{}
+	if err := json.Unmarshal(w.Body.Bytes(), &downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if downloaded.Schedule != state.Schedule || !downloaded.Running || downloaded.OpMode != "cool" {
+		t.Errorf("downloaded state differs: %+v", downloaded)
+	}
+}
+
+func TestDaySchedules(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 9 everyday on"
+	saveState(t, ctx, state)
+	serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"day": {"mon"}, "sched": {"0 7 everyday on"}})
+	state = mustState(t, ctx)
+	if state.Schedule != "0 9 everyday on" || state.DaySchedules["mon"] != "0 7 everyday on" {
+		t.Fatalf("monday schedule not stored on its own: %+v", state)
+	}
+	for _, now := range []time.Time{
+		time.Date(2024, time.January, 1, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, time.January, 2, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, time.January, 8, 8, 0, 0, 0, time.UTC),
+	} {
+		action, err := ctx.parseScheduleAt(state.scheduleFor(dayName(now.Weekday())), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := offAction
+		if now.Weekday() == time.Monday {
+			want = onAction
+		}
+		if action != want {
+			t.Errorf("%s at 08:00: got %q, want %q", now.Weekday(), action, want)
+		}
+	}
+	serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"day": {"mon"}, "sched": {""}})
+	if state := mustState(t, ctx); len(state.DaySchedules) != 0 || state.scheduleFor("mon") != "0 9 everyday on" {
+		t.Errorf("cleared monday schedule does not fall back: %+v", state)
+	}
+}
+
+func TestGateCommand(t *testing.T) {
+	dir := t.TempDir()
+	occupied := filepath.Join(dir, "occupied")
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.GateCommand = []string{"test", "-e", occupied}
+	})
+	state := newTestState()
+	state.Schedule = "0 0 * on"
+	saveState(t, ctx, state)
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{}); w.Code == http.StatusSeeOther {
+		t.Error("denied on was not an error")
+	}
+	if state := mustState(t, ctx); state.Override || !state.LastManual.IsZero() {
+		t.Errorf("denied on was marked manual: %+v", state)
+	}
+	if err := doScheduled(ctx); !errors.Is(err, errGateDenied) || ctx.trace.get().Reason != "gate" {
+		t.Errorf("scheduled on not denied: %v", err)
+	}
+	if mustState(t, ctx).Running || len(sent(t, ctx)) != 0 {
+		t.Fatal("denied on actuated")
+	}
+	if err := os.WriteFile(occupied, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !mustState(t, ctx).Running || len(sent(t, ctx)) != 1 {
+		t.Error("allowed on did not actuate")
+	}
+	if err := os.Remove(occupied); err != nil {
+		t.Fatal(err)
+	}
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	if mustState(t, ctx).Running {
+		t.Error("off was gated")
+	}
+}
+
+func TestGateTimeout(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.GateCommand = []string{"sleep", "10"}
+		c.GateTimeout = 1
+	})
+	state := newTestState()
+	state.Schedule = "0 0 * on"
+	saveState(t, ctx, state)
+	start := time.Now()
+	err := doScheduled(ctx)
+	if !errors.Is(err, errGateDenied) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("slow gate not denied: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gate was not bounded by its timeout: %s", elapsed)
+	}
+	if mustState(t, ctx).Running || len(sent(t, ctx)) != 0 {
+		t.Error("timed out gate actuated")
+	}
+}
+
+func TestScheduleJSONRoundTrip(t *testing.T) {
+	schedule := "# mornings\n@wake = 30 6\n@wake weekday on # early\n0 9 sat-sun on dry\n22:00-23:30 * off\n0 23 * on"
+	source := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = schedule
+	saveState(t, source, state)
+	exported := serve(source, http.MethodGet, "/wit/schedule.json", nil).Body.String()
+	// the export carries the token of the schedule it was made from
+	r := httptest.NewRequest(http.MethodPost, "/wit/schedule.json", strings.NewReader(exported))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	doActionCall(w, r, source)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("import failed: %d %s", w.Code, w.Body)
+	}
+	imported := mustState(t, source).Schedule
+	if strings.Contains(imported, "#") || strings.Contains(imported, "@wake") {
+		t.Errorf("imported schedule is not canonical: %q", imported)
+	}
+	for now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC); now.Before(time.Date(2024, time.January, 8, 0, 0, 0, 0, time.UTC)); now = now.Add(30 * time.Minute) {
+		want, err := source.resolveScheduleAt(schedule, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := source.resolveScheduleAt(imported, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.action != want.action || got.mode != want.mode {
+			t.Fatalf("%s: imported %q %q, original %q %q", now.Format("Mon 15:04"), got.action, got.mode, want.action, want.mode)
+		}
+	}
+	r = httptest.NewRequest(http.MethodPost, "/wit/schedule.json", strings.NewReader(`{"day":"all","entries":[{"hour":25,"minute":0,"day":"*","action":"on"}]}`))
+	w = httptest.NewRecorder()
+	doActionCall(w, r, source)
+	if w.Code != http.StatusBadRequest || mustState(t, source).Schedule != imported {
+		t.Errorf("invalid import accepted: %d", w.Code)
+	}
+}
+
+func TestStateRetry(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.StateRetries = 3
+	})
+	state := newTestState()
+	state.Schedule = "0 0 * on"
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of the state file fails the read until it is swapped back
+	if err := os.Mkdir(ctx.stateFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.getState(); err == nil {
+		t.Fatal("state read did not fail")
+	}
+	restored := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := os.Remove(ctx.stateFile); err != nil {
+			restored <- err
+			return
+		}
+		restored <- os.WriteFile(ctx.stateFile, data, 0644)
+	}()
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-restored; err != nil {
+		t.Fatal(err)
+	}
+	if trace := ctx.trace.get(); trace.Outcome != outcomeActuated || !mustState(t, ctx).Running {
+		t.Errorf("transition missed after a transient failure: %+v", trace)
+	}
+	if err := os.Remove(ctx.stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(ctx.stateFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx.cfg.StateRetries = 1
+	if err := doScheduled(ctx); err == nil {
+		t.Error("persistent failure was not reported")
+	}
+}
+
+func TestRuntimeReport(t *testing.T) {
+	at := func(day, hour int) time.Time {
+		return time.Date(2024, time.January, day, hour, 0, 0, 0, time.UTC)
+	}
+	history := []Transition{
+		{Time: at(1, 10), Running: true, Mode: "cool"},
+		{Time: at(1, 12), Running: false},
+		{Time: at(1, 23), Running: true, Mode: "cool"},
+		{Time: at(2, 1), Running: false},
+		{Time: at(4, 20), Running: true, Mode: "dry"},
+	}
+	report := runtimeReport(history, at(4, 22), time.UTC)
+	want := []DayRuntime{
+		{Date: "2024-01-01", Seconds: 3 * 3600},
+		{Date: "2024-01-02", Seconds: 3600},
+		{Date: "2024-01-03", Seconds: 0},
+		{Date: "2024-01-04", Seconds: 2 * 3600},
+	}
+	if fmt.Sprint(report) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", report, want)
+	}
+	// the same history bucketed six hours behind moves the overnight run to the first day
+	behind := time.FixedZone("behind", -6*3600)
+	if report := runtimeReport(history[:4], at(2, 12), behind); fmt.Sprint(report) != fmt.Sprint([]DayRuntime{{Date: "2024-01-01", Seconds: 4 * 3600}, {Date: "2024-01-02", Seconds: 0}}) {
+		t.Errorf("not bucketed in the location: %v", report)
+	}
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.History = history
+	saveState(t, ctx, state)
+	served := []DayRuntime{}
+	if err := json.Unmarshal(serve(ctx, http.MethodGet, "/wit/report", nil).Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) < len(want) || fmt.Sprint(served[:3]) != fmt.Sprint(want[:3]) {
+		t.Errorf("unexpected report: %v", served)
+	}
+}
+
+func TestMissingLIRCConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "lircd.conf")
+	cfg := Configuration{LIRC: LIRCConfiguration{Config: missing}}
+	if err := cfg.parseLIRCConfig(); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("missing config at startup: %v", err)
+	}
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.LIRC.CheckConfig = true
+	})
+	saveState(t, ctx, newTestState())
+	if err := os.Remove(ctx.cfg.LIRC.Config); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if !strings.Contains(w.Body.String(), "config file for lirc does not exist: "+ctx.cfg.LIRC.Config) {
+		t.Errorf("missing config before actuation: %s", w.Body)
+	}
+	if len(sent(t, ctx)) != 0 || mustState(t, ctx).Running {
+		t.Error("actuated with a missing config")
+	}
+}
+
+func TestGETMutationsDisabled(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.GETMutationsDisabled = true
+	})
+	saveState(t, ctx, newTestState())
+	for _, action := range []string{onAction, offAction, "toggle", "calibrate", "togglelock"} {
+		w := serve(ctx, http.MethodGet, "/wit/"+action, nil)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+			t.Errorf("GET %s: %d", action, w.Code)
+		}
+	}
+	if w := serve(ctx, http.MethodGet, "/wit/display", nil); w.Code != http.StatusOK {
+		t.Errorf("GET display: %d", w.Code)
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{}); w.Code != http.StatusSeeOther || !mustState(t, ctx).Running {
+		t.Errorf("POST on: %d", w.Code)
+	}
+}
+
+func TestScheduleTable(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	rows := url.Values{
+		"day":       {"all"},
+		"default":   {"off"},
+		"time":      {"07:30", "", "22:00"},
+		"dayof":     {"weekday", "", "*"},
+		"action":    {"on", "on", "off"},
+		"entrymode": {"dry", "", ""},
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/scheduletable", rows); w.Code != http.StatusSeeOther {
+		t.Fatalf("table not saved: %d %s", w.Code, w.Body)
+	}
+	schedule := mustState(t, ctx).Schedule
+	if schedule != "@default off\n30 7 weekday on dry\n0 22 * off" {
+		t.Errorf("unexpected schedule: %q", schedule)
+	}
+	wednesday := time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		at     time.Duration
+		action string
+		mode   string
+	}{
+		{7 * time.Hour, offAction, ""},
+		{7*time.Hour + 30*time.Minute, onAction, "dry"},
+		{22 * time.Hour, offAction, ""},
+	} {
+		timing, err := ctx.resolveScheduleAt(schedule, wednesday.Add(test.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timing.action != test.action || timing.mode != test.mode {
+			t.Errorf("%s: got %q %q, want %q %q", test.at, timing.action, timing.mode, test.action, test.mode)
+		}
+	}
+	rows.Set("time", "25:00")
+	rows["dayof"], rows["action"], rows["entrymode"] = []string{"weekday"}, []string{"on"}, []string{""}
+	if w := serve(ctx, http.MethodPost, "/wit/scheduletable", rows); w.Code != http.StatusBadRequest || mustState(t, ctx).Schedule != schedule {
+		t.Errorf("invalid table accepted: %d", w.Code)
+	}
+}
+
+func TestPanicFile(t *testing.T) {
+	trigger := filepath.Join(t.TempDir(), "panic")
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.PanicFile = trigger
+	})
+	state := newTestState()
+	state.Schedule = "0 0 * on"
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(trigger, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.maintain(time.Now(), time.Now(), false); err != nil {
+		t.Fatal(err)
+	}
+	state = mustState(t, ctx)
+	if state.Running || !state.Panic {
+		t.Fatalf("panic did not force off: %+v", state)
+	}
+	if calls := sent(t, ctx); len(calls) != 2 || !strings.HasSuffix(calls[1], "coolSTOP") {
+		t.Errorf("no off actuation: %v", calls)
+	}
+	if lines, err := ctx.readHistory(1); err != nil || len(lines) != 1 || !strings.Contains(lines[0], "action=off mode=cool running=false source=schedule") {
+		t.Errorf("forced off not in the history: %v %v", lines, err)
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if trace := ctx.trace.get(); trace.Reason != "panic" || mustState(t, ctx).Running {
+		t.Errorf("schedule not suppressed: %+v", trace)
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{}); !strings.Contains(w.Body.String(), errPanic.Error()) {
+		t.Errorf("web on allowed during panic: %d", w.Code)
+	}
+	if err := os.WriteFile(trigger, []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.maintain(time.Now(), time.Now(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state := mustState(t, ctx); state.Panic || !state.Running {
+		t.Errorf("schedule did not resume after the panic cleared: %+v", state)
+	}
+}
+
+func TestDisplayCaching(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.DisplayMaxAge = 30
+	})
+	saveState(t, ctx, newTestState())
+	w := serve(ctx, http.MethodGet, "/wit/display", nil)
+	if cache := w.Header().Get("Cache-Control"); cache != "private, max-age=30" {
+		t.Errorf("display cache control: %q", cache)
+	}
+	if expires, err := http.ParseTime(w.Header().Get("Expires")); err != nil || time.Until(expires) <= 0 {
+		t.Errorf("display expires: %q %v", w.Header().Get("Expires"), err)
+	}
+	for _, action := range []string{"current", "status"} {
+		if cache := serve(ctx, http.MethodGet, "/wit/"+action, nil).Header().Get("Cache-Control"); cache != "no-store" {
+			t.Errorf("%s cache control: %q", action, cache)
+		}
+	}
+	uncached := newTestContext(t, nil)
+	saveState(t, uncached, newTestState())
+	if cache := serve(uncached, http.MethodGet, "/wit/display", nil).Header().Get("Cache-Control"); cache != "no-store" {
+		t.Errorf("display cached by default: %q", cache)
+	}
+}
+
+func TestModeNameValidation(t *testing.T) {
+	for _, test := range []struct {
+		codes []string
+		err   string
+	}{
+		{[]string{"cool;rmSTART", "cool;rmSTOP"}, "invalid character"},
+		{[]string{strings.Repeat("x", 40) + "START", strings.Repeat("x", 40) + "STOP"}, "invalid mode name length (40)"},
+		{[]string{"START", "STOP"}, "invalid mode name length (0)"},
+	} {
+		cfg := Configuration{LIRC: LIRCConfiguration{Config: writeLIRC(t, "testac", test.codes...)}}
+		if err := cfg.parseLIRCConfig(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: %v", test.codes, err)
+		}
+	}
+	long := strings.Repeat("x", 40)
+	cfg := Configuration{MaxModeLength: 40, LIRC: LIRCConfiguration{Config: writeLIRC(t, "testac", long+"START", long+"STOP")}}
+	if err := cfg.parseLIRCConfig(); err != nil {
+		t.Errorf("mode within the configured length: %v", err)
+	}
+}
+
+func TestResolveScheduleAt(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	at := func(hour, min int) time.Time {
+		return time.Date(2024, time.January, 3, hour, min, 0, 0, time.UTC)
+	}
+	overnight := "0 6 everyday off\n0 22 everyday on"
+	for _, test := range []struct {
+		name     string
+		schedule string
+		now      time.Time
+		action   string
+		line     string
+	}{
+		{"baseline at midnight", "0 7 everyday on", at(0, 0), offAction, "baseline"},
+		{"default on at midnight", "@default on\n0 7 everyday off", at(0, 0), onAction, "@default on"},
+		{"before the first entry", "0 7 everyday on", at(6, 59), offAction, "baseline"},
+		{"exactly at the entry", "0 7 everyday on", at(7, 0), onAction, "0 7 everyday on"},
+		{"later minute, earlier hour", "30 9 everyday on", at(10, 5), onAction, "30 9 everyday on"},
+		{"entries out of order", "0 22 everyday off\n0 7 everyday on", at(12, 0), onAction, "0 7 everyday on"},
+		{"overnight before off", "@default on\n" + overnight, at(3, 0), onAction, "@default on"},
+		{"overnight after off", "@default on\n" + overnight, at(6, 0), offAction, "0 6 everyday off"},
+		{"overnight after on", "@default on\n" + overnight, at(23, 59), onAction, "0 22 everyday on"},
+		{"same minute, later wins", "0 7 everyday on\n0 7 everyday on", at(7, 0), onAction, "0 7 everyday on"},
+		{"no baseline", "@default none\n0 7 everyday on", at(6, 0), noAction, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			timing, err := ctx.resolveScheduleAt(test.schedule, test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if timing.action != test.action || timing.line != test.line {
+				t.Errorf("got %q from %q, want %q from %q", timing.action, timing.line, test.action, test.line)
+			}
+		})
+	}
+}
+
+func TestMinuteOfDay(t *testing.T) {
+	for _, test := range []struct {
+		hour, min, minute int
+	}{
+		{0, 0, 0},
+		{9, 30, 570},
+		{10, 5, 605},
+		{23, 59, 1439},
+	} {
+		if minute := newScheduleTime(test.hour, test.min, onAction).minuteOfDay(); minute != test.minute {
+			t.Errorf("%02d:%02d is minute %d, want %d", test.hour, test.min, minute, test.minute)
+		}
+	}
+}
+
+func TestModeSuffixes(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.LIRC.Config = writeLIRC(t, "testac", "cool_ON", "cool_OFF", "fan_ON", "fan_OFF")
+		c.LIRC.StartSuffix = "_ON"
+		c.LIRC.StopSuffix = "_OFF"
+	})
+	if modes := strings.Join(ctx.cfg.opModes, ","); modes != "cool,fan" {
+		t.Errorf("modes not discovered: %s", modes)
+	}
+	saveState(t, ctx, newTestState())
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	if calls := sent(t, ctx); len(calls) != 2 || !strings.HasSuffix(calls[0], "testac cool_ON") || !strings.HasSuffix(calls[1], "testac cool_OFF") {
+		t.Errorf("suffixes not sent: %v", calls)
+	}
+	cfg := ctx.cfg
+	cfg.LIRC.StopSuffix = "_ON"
+	if err := cfg.parseLIRCConfig(); err == nil {
+		t.Error("identical suffixes accepted")
+	}
+	cfg.LIRC.Config = writeLIRC(t, "testac", "coolSTART", "coolSTOP")
+	cfg.LIRC.StopSuffix = "_OFF"
+	if err := cfg.parseLIRCConfig(); err == nil {
+		t.Error("codes without the configured suffixes accepted")
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.BasePath = "/home/ac/"
+	})
+	saveState(t, ctx, newTestState())
+	// the proxy strips /home/ac before the request reaches wit
+	w := serve(ctx, http.MethodPost, "/wit/togglelock", url.Values{})
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || location != "/home/ac/wit/display" {
+		t.Errorf("redirect: %d %q", w.Code, location)
+	}
+	if body := serve(ctx, http.MethodGet, "/wit/display", nil).Body.String(); !strings.Contains(body, "/home/ac/wit/") {
+		t.Error("display links lack the base path")
+	}
+}
+
+func TestEverydaySchedule(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	for _, day := range []time.Time{
+		time.Date(2024, time.January, 6, 7, 0, 0, 0, time.UTC),
+		time.Date(2024, time.January, 2, 7, 0, 0, 0, time.UTC),
+	} {
+		for _, schedule := range []string{"0 7 everyday on", "0 7 all on"} {
+			action, err := ctx.parseScheduleAt(schedule, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action != onAction {
+				t.Errorf("%q on %s: %q", schedule, day.Weekday(), action)
+			}
+		}
+	}
+	if _, err := ctx.parseSchedule("0 7 sometimes on"); err == nil || !strings.Contains(err.Error(), "sometimes") {
+		t.Errorf("unknown day type: %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	serve(ctx, http.MethodPost, "/wit/apply", url.Values{"mode": {"dry"}, "action": {onAction}})
+	state := mustState(t, ctx)
+	if !state.Running || state.OpMode != "dry" || state.RunningMode != "dry" {
+		t.Fatalf("apply did not set the mode and turn on: %+v", state)
+	}
+	if calls := sent(t, ctx); len(calls) != 1 || !strings.HasSuffix(calls[0], "SEND_ONCE testac drySTART") {
+		t.Errorf("apply did not actuate once in the requested mode: %v", calls)
+	}
+	serve(ctx, http.MethodPost, "/wit/apply", url.Values{"mode": {"dry"}, "action": {onAction}})
+	if calls := sent(t, ctx); len(calls) != 1 {
+		t.Errorf("apply resent the running mode: %v", calls)
+	}
+	serve(ctx, http.MethodPost, "/wit/apply", url.Values{"mode": {"cool"}, "action": {"maybe"}})
+	if state := mustState(t, ctx); state.OpMode != "dry" || !state.Running {
+		t.Errorf("invalid apply changed the state: %+v", state)
+	}
+	serve(ctx, http.MethodPost, "/wit/apply", url.Values{"mode": {"dry"}, "action": {offAction}})
+	if calls := sent(t, ctx); len(calls) != 2 || !strings.HasSuffix(calls[1], "SEND_ONCE testac drySTOP") {
+		t.Errorf("apply did not turn off: %v", calls)
+	}
+	if mustState(t, ctx).Running {
+		t.Error("apply off left the unit running")
+	}
+}
+
+func TestParseScheduleAtDayTypes(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	schedule := "0 7 weekday on\n0 22 weekday off\n0 9 weekend on\n0 23 weekend off"
+	wednesday := time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC)
+	saturday := time.Date(2024, time.January, 6, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		day    time.Time
+		hour   int
+		action string
+	}{
+		{wednesday, 7, onAction},
+		{wednesday, 8, onAction},
+		{wednesday, 22, offAction},
+		{saturday, 7, offAction},
+		{saturday, 8, offAction},
+		{saturday, 9, onAction},
+		{saturday, 22, onAction},
+		{saturday, 23, offAction},
+	} {
+		now := test.day.Add(time.Duration(test.hour) * time.Hour)
+		action, err := ctx.parseScheduleAt(schedule, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != test.action {
+			t.Errorf("%s: got %q, want %q", now.Format("Mon 15:04"), action, test.action)
+		}
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	jitter := rand.New(rand.NewSource(1))
+	if sleep := (Configuration{}).schedulerSleep(jitter); sleep != schedulerTick {
+		t.Errorf("sleep without jitter: %s", sleep)
+	}
+	cfg := Configuration{PollInterval: 10, SchedulerJitterSeconds: 2}
+	varied := false
+	first := cfg.schedulerSleep(jitter)
+	for idx := 0; idx < 100; idx++ {
+		sleep := cfg.schedulerSleep(jitter)
+		if sleep < 8*time.Second || sleep > 12*time.Second {
+			t.Fatalf("sleep outside the jitter band: %s", sleep)
+		}
+		varied = varied || sleep != first
+	}
+	if !varied {
+		t.Error("sleeps did not vary")
+	}
+	cfg = Configuration{PollInterval: 1, SchedulerJitterSeconds: 5}
+	for idx := 0; idx < 100; idx++ {
+		if sleep := cfg.schedulerSleep(jitter); sleep < time.Second {
+			t.Fatalf("sleep below a second: %s", sleep)
+		}
+	}
+}
+
+func TestScheduleComments(t *testing.T) {
+	entries, _, err := parseScheduleTimes("# schedule\n\n30 6 weekday on # morning warmup\n   # indented comment\n0 22 weekday off#bedtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if first := entries[0]; first.hour != 6 || first.min != 30 || first.day != weekdayType || first.action != onAction || first.line != "30 6 weekday on" {
+		t.Errorf("commented line parsed wrong: %+v", first)
+	}
+	if second := entries[1]; second.hour != 22 || second.action != offAction {
+		t.Errorf("comment without a space parsed wrong: %+v", second)
+	}
+}
+
+func TestDefaultDirective(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.Baseline = offAction
+	})
+	early := time.Date(2024, time.January, 3, 5, 0, 0, 0, time.UTC)
+	timing, err := ctx.resolveScheduleAt("@default on\n0 9 everyday off", early)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timing.action != onAction || timing.line != "@default on" {
+		t.Errorf("directive not applied before the first entry: %+v", timing)
+	}
+	for _, invalid := range []string{"@default maybe", "@default on\n@default off", "@default"} {
+		if _, err := ctx.parseSchedule(invalid); err == nil {
+			t.Errorf("invalid directive accepted: %q", invalid)
+		}
+	}
+	if _, err := ctx.parseSchedule("@later on"); err == nil {
+		t.Error("unknown directive accepted")
+	}
+}
+
+func TestOverrideStatus(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.OverrideTimeout = 7200
+		c.PersistOverride = true
+	})
+	saveState(t, ctx, newTestState())
+	if body := strings.TrimSpace(serve(ctx, http.MethodGet, "/wit/override/status", nil).Body.String()); body != `{"active":false}` {
+		t.Errorf("inactive override: %s", body)
+	}
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	state := mustState(t, ctx)
+	status := OverrideStatus{}
+	if err := json.Unmarshal(serve(ctx, http.MethodGet, "/wit/override/status", nil).Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Active || status.ExpiresAt == nil || !status.ExpiresAt.Equal(state.OverrideUntil) {
+		t.Errorf("override status: %+v, until %s", status, state.OverrideUntil)
+	}
+	if until := time.Until(*status.ExpiresAt); until < 119*time.Minute || until > 2*time.Hour {
+		t.Errorf("override expires in %s", until)
+	}
+	ctx.cfg.PersistOverride = false
+	now := time.Date(2024, time.January, 3, 23, 0, 0, 0, time.UTC)
+	status = ctx.overrideStatus(&State{Override: true, OverrideUntil: now.Add(2 * time.Hour)}, now)
+	if want := time.Date(2024, time.January, 4, 0, 0, 0, 0, time.UTC); status.ExpiresAt == nil || !status.ExpiresAt.Equal(want) {
+		t.Errorf("midnight before the timeout: %v", status.ExpiresAt)
+	}
+}
+
+func TestPartialWriteKeepsState(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 7 everyday on"
+	saveState(t, ctx, state)
+	partial := filepath.Join(filepath.Dir(ctx.stateFile), ".state.json.123456")
+	if err := os.WriteFile(partial, []byte(`{"OpMode":"dry","Sched`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, reader := range []context{ctx, ctx.cfg.newContext()} {
+		if got := mustState(t, reader); got.Schedule != state.Schedule || got.OpMode != "cool" {
+			t.Errorf("last good state not read: %+v", got)
+		}
+	}
+	state.Schedule = "0 8 everyday on"
+	saveState(t, ctx, state)
+	if got := mustState(t, ctx.cfg.newContext()); got.Schedule != state.Schedule {
+		t.Errorf("state not replaced: %+v", got)
+	}
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(ctx.stateFile), ".state.json.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0] != partial {
+		t.Errorf("unexpected temporary files: %v", matches)
+	}
+}
+
+func TestScheduleToken(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 7 everyday on"
+	saveState(t, ctx, state)
+	stale := scheduleToken(state.Schedule)
+	if w := serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"sched": {"0 8 everyday on"}, "token": {stale}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("current token refused: %d", w.Code)
+	}
+	w := serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"sched": {"0 9 everyday on"}, "token": {stale}})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "0 8 everyday on") {
+		t.Errorf("stale token: %d %s", w.Code, w.Body)
+	}
+	if schedule := mustState(t, ctx).Schedule; schedule != "0 8 everyday on" {
+		t.Errorf("stale edit overwrote the schedule: %q", schedule)
+	}
+	if body := serve(ctx, http.MethodGet, "/wit/display", nil).Body.String(); !strings.Contains(body, scheduleToken("0 8 everyday on")) {
+		t.Error("display does not carry the current token")
+	}
+	ctx.cfg.RequireScheduleToken = true
+	if w := serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"sched": {"0 9 everyday on"}}); w.Code != http.StatusConflict {
+		t.Errorf("missing token when required: %d", w.Code)
+	}
+}
+
+func TestCronLines(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		configure func(*Configuration)
+		curl      string
+	}{
+		{"plain", nil, "curl -s -X POST http://localhost:7900/wit/"},
+		{"tls", func(c *Configuration) {
+			c.TLSCert = "cert.pem"
+			c.TLSKey = "key.pem"
+		}, "curl -s -X POST https://localhost:7900/wit/"},
+		{"auth", func(c *Configuration) {
+			c.Username = "admin"
+			c.Password = "it's 100%"
+		}, `curl -s -u 'admin:it'\''s 100\%' -X POST http://localhost:7900/wit/`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newTestContext(t, test.configure)
+			state := newTestState()
+			state.Schedule = "30 7 weekday on\n0 22 weekend off"
+			saveState(t, ctx, state)
+			lines, err := ctx.cronLines()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{
+				"0 0 * * * " + test.curl + "off",
+				"30 7 * * 1-5 " + test.curl + "on",
+				"0 22 * * 6-7 " + test.curl + "off",
+			}
+			if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	for _, actuates := range []bool{false, true} {
+		ctx := newTestContext(t, func(c *Configuration) {
+			c.CalibrateActuates = actuates
+		})
+		saveState(t, ctx, newTestState())
+		serve(ctx, http.MethodPost, "/wit/calibrate", url.Values{})
+		if !mustState(t, ctx).Running {
+			t.Errorf("calibrate did not flip the state (actuates %t)", actuates)
+		}
+		calls := sent(t, ctx)
+		if !actuates && len(calls) != 0 {
+			t.Errorf("sync-only calibrate actuated: %v", calls)
+		}
+		if actuates && (len(calls) != 1 || !strings.HasSuffix(calls[0], "coolSTART")) {
+			t.Errorf("calibrate did not actuate: %v", calls)
+		}
+	}
+}
+
+func TestSharedCooldown(t *testing.T) {
+	configure := func(c *Configuration) {
+		c.Cooldown = 600
+	}
+	ctx := newTestContext(t, configure)
+	state := newTestState()
+	state.Schedule = "0 0 everyday on"
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "try again in") {
+		t.Errorf("web off right after a scheduled on: %d %s", w.Code, w.Body)
+	}
+	if !mustState(t, ctx).Running || len(sent(t, ctx)) != 1 {
+		t.Error("web off actuated within the cooldown")
+	}
+	// fired together, whichever goes second is held by the cooldown (or, after a web action, its override)
+	ctx = newTestContext(t, configure)
+	saveState(t, ctx, state)
+	done := &sync.WaitGroup{}
+	done.Add(2)
+	go func() {
+		defer done.Done()
+		if err := doScheduled(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer done.Done()
+		serve(ctx, http.MethodPost, "/wit/toggle", url.Values{})
+	}()
+	done.Wait()
+	if calls := sent(t, ctx); len(calls) != 1 {
+		t.Errorf("both sources actuated within the cooldown: %v", calls)
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("neither source turned the unit on")
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	if interval := (Configuration{}).pollInterval(); interval != 5*time.Second {
+		t.Errorf("default poll interval: %s", interval)
+	}
+	if interval := (Configuration{PollInterval: 60}).pollInterval(); interval != time.Minute {
+		t.Errorf("configured poll interval: %s", interval)
+	}
+	if err := (Configuration{PollInterval: -1}).checkPollInterval(); err == nil {
+		t.Error("negative poll interval accepted")
+	}
+	if err := (Configuration{}).checkPollInterval(); err != nil {
+		t.Errorf("default poll interval rejected: %v", err)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels   string
+		yes, no  string
+		accepted bool
+	}{
+		{"", "YES", "NO", true},
+		{"true-false", "true", "false", true},
+		{"1-0", "1", "0", true},
+		{"oui-non", "", "", false},
+	} {
+		cfg := Configuration{Labels: test.labels}
+		if err := cfg.checkLabels(); (err == nil) != test.accepted {
+			t.Errorf("labels %q accepted %t: %v", test.labels, test.accepted, err)
+		}
+		if !test.accepted {
+			continue
+		}
+		ctx := newTestContext(t, func(c *Configuration) {
+			c.Labels = test.labels
+		})
+		state := newTestState()
+		state.Running = true
+		state.Manual = true
+		saveState(t, ctx, state)
+		if current := serve(ctx, http.MethodGet, "/wit/current", nil).Body.String(); !strings.HasPrefix(current, test.yes+" (") {
+			t.Errorf("current with %q labels: %s", test.labels, current)
+		}
+		display := serve(ctx, http.MethodGet, "/wit/display", nil).Body.String()
+		if !strings.Contains(display, ">"+test.yes+"<") || !strings.Contains(display, ">"+test.no+"<") {
+			t.Errorf("display without %q labels", test.labels)
+		}
+	}
+}
+
+func TestIRSendOutput(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	fakeIRSend(t, ctx, "echo 'irsend: hardware does not support sending' >&2\nexit 1")
+	w := serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "exit status 1: irsend: hardware does not support sending") {
+		t.Errorf("irsend output not reported: %d %s", w.Code, w.Body)
+	}
+	if mustState(t, ctx).Running {
+		t.Error("failed actuation changed the state")
+	}
+}
+
+func TestIRSendRetries(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.IRSendRetries = 0
+	})
+	saveState(t, ctx, newTestState())
+	// fails the first time only, the marker records that it has
+	marker := filepath.Join(ctx.cfg.Cache, "failed-once")
+	fakeIRSend(t, ctx, fmt.Sprintf("if [ ! -e %q ]; then touch %q; echo 'irsend: timeout' >&2; exit 1; fi", marker, marker))
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Fatalf("flaky irsend not retried: %d %s", w.Code, w.Body)
+	}
+	if calls := sent(t, ctx); len(calls) != 2 || !mustState(t, ctx).Running {
+		t.Errorf("unexpected irsend calls: %v", calls)
+	}
+	for retries, want := range map[int]int{-1: 0, 0: 1, 3: 3} {
+		if got := (Configuration{IRSendRetries: retries}).irsendRetries(); got != want {
+			t.Errorf("retries %d: got %d, want %d", retries, got, want)
+		}
+	}
+}
+
+func TestIRSendTimeout(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.IRSendTimeout = 1
+	})
+	state := newTestState()
+	state.Schedule = "0 0 everyday on"
+	saveState(t, ctx, state)
+	fakeIRSend(t, ctx, "exec sleep 10")
+	start := time.Now()
+	err := doScheduled(ctx)
+	if err == nil || !strings.Contains(err.Error(), "irsend timed out sending coolSTART") {
+		t.Errorf("hung irsend: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("irsend was not bounded by the timeout: %s", elapsed)
+	}
+	if mustState(t, ctx).Running {
+		t.Error("timed out actuation changed the state")
+	}
+	if timeout := (Configuration{}).irsendTimeout(); timeout != irsendTimeout {
+		t.Errorf("default timeout: %s", timeout)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.DryRun = true
+	})
+	saveState(t, ctx, newTestState())
+	output := captureLogs(t, levelInfo, func() {
+		serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	})
+	if !strings.Contains(output, "dry run, not sending: SEND_ONCE testac coolSTART") {
+		t.Errorf("dry run not logged: %s", output)
+	}
+	if len(sent(t, ctx)) != 0 {
+		t.Error("dry run ran irsend")
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("dry run did not change the state")
+	}
+}
+
+// runScheduler runs the scheduler daemon until it has made a decision.
+func runScheduler(t *testing.T, ctx context) {
+	t.Helper()
+	stop, cancel := gocontext.WithCancel(gocontext.Background())
+	done := &sync.WaitGroup{}
+	done.Add(1)
+	go schedulerDaemon(ctx, stop, done)
+	defer func() {
+		cancel()
+		done.Wait()
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ctx.trace.get() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduler did not run")
+		}
+	}
+}
+
+func TestRestartKeepsManualOverride(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.PollInterval = 1
+	})
+	state := newTestState()
+	state.Manual = true
+	state.Override = true
+	saveState(t, ctx, state)
+	runScheduler(t, ctx)
+	if !mustState(t, ctx).Override {
+		t.Error("override cleared on the first tick after a restart")
+	}
+	if _, err := ctx.maintain(time.Now(), time.Now(), false); err != nil {
+		t.Fatal(err)
+	}
+	if mustState(t, ctx).Override {
+		t.Error("override kept when entering manual")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	request := func(mux *http.ServeMux, user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/wit/current", nil)
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	if w := request(newTestServer(t, ctx.cfg), "", ""); w.Code != http.StatusOK {
+		t.Errorf("no auth configured: %d", w.Code)
+	}
+	cfg := ctx.cfg
+	cfg.Username = "admin"
+	cfg.Password = "secret"
+	mux := newTestServer(t, cfg)
+	if w := request(mux, "admin", "secret"); w.Code != http.StatusOK {
+		t.Errorf("authorized: %d", w.Code)
+	}
+	for _, credentials := range [][2]string{{"", ""}, {"admin", "wrong"}, {"guest", "secret"}} {
+		w := request(mux, credentials[0], credentials[1])
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="wit"` {
+			t.Errorf("unauthorized %v: %d %q", credentials, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestCheckOpMode(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.OpMode = "turbo"
+	state.Schedule = "0 7 everyday on"
+	saveState(t, ctx, state)
+	if err := ctx.checkOpMode(); err != nil {
+		t.Fatal(err)
+	}
+	state = mustState(t, ctx)
+	if state.OpMode != "cool" || state.Schedule != "0 7 everyday on" {
+		t.Errorf("unknown mode not reset to the first mode: %+v", state)
+	}
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if !mustState(t, ctx).Running {
+		t.Error("on failed after the reset")
+	}
+	fresh := newTestContext(t, nil)
+	output := captureLogs(t, levelWarn, func() {
+		if err := fresh.checkOpMode(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if output != "" || mustState(t, fresh).OpMode != "cool" {
+		t.Errorf("fresh state not given the default mode quietly: %s %+v", output, mustState(t, fresh))
+	}
+}
+
+func TestParseConfigName(t *testing.T) {
+	for line, want := range map[string]string{
+		"name BRYANT":        "BRYANT",
+		"name   Living Room": "Living Room",
+		"name\tBRYANT\tHeat": "BRYANT Heat",
+		"\tname \t BRYANT  ": "BRYANT",
+		"name":               "",
+		"bits 16":            "",
+		"named BRYANT":       "",
+	} {
+		if got := parseConfigName(line); got != want {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+	name, codes := parseClassicLIRC("begin remote\n\tname\tLiving Room\n  begin raw_codes\n    name coolSTART\n  end raw_codes\nend remote\n")
+	if name != "Living Room" || len(codes) != 1 || codes[0] != "coolSTART" {
+		t.Errorf("unexpected remote: %q %v", name, codes)
+	}
+}
+
+func TestMixedWhitespace(t *testing.T) {
+	config := "begin remote\n\tname\ttestac\n\tbegin\traw_codes\n\t\tname coolSTART\n\t\t\t100 200\n\t\tname\tcoolSTOP\n\t\t\t100 200\n\tend raw_codes\nend remote\n"
+	name, codes := parseClassicLIRC(config)
+	if name != "testac" || strings.Join(codes, ",") != "coolSTART,coolSTOP" {
+		t.Fatalf("tab-indented config: %q %v", name, codes)
+	}
+	ctx := newTestContext(t, nil)
+	now := time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)
+	for _, schedule := range []string{
+		"0 7 everyday on\n0 22 everyday off",
+		"0\t7 everyday\ton\n\t0  22\t\teveryday off  ",
+		"  07:00-22:00 \t everyday on",
+	} {
+		action, err := ctx.parseScheduleAt(schedule, now)
+		if err != nil || action != onAction {
+			t.Errorf("%q: %s %v", schedule, action, err)
+		}
+	}
+}
+
+func TestToggle(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	serve(ctx, http.MethodPost, "/wit/toggle", url.Values{})
+	if !mustState(t, ctx).Running {
+		t.Fatal("first toggle did not turn on")
+	}
+	serve(ctx, http.MethodPost, "/wit/toggle", url.Values{})
+	if mustState(t, ctx).Running {
+		t.Error("second toggle did not return to off")
+	}
+	calls := sent(t, ctx)
+	if len(calls) != 2 || !strings.HasSuffix(calls[0], "coolSTART") || !strings.HasSuffix(calls[1], "coolSTOP") {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+}
+
+func TestForceOff(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	if mustState(t, ctx).Running {
+		t.Fatal("state should start off")
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/forceoff", url.Values{}); w.Code >= 400 {
+		t.Fatalf("forceoff failed: %d %s", w.Code, w.Body.String())
+	}
+	if calls := sent(t, ctx); len(calls) != 1 || !strings.HasSuffix(calls[0], "testac coolSTOP") {
+		t.Errorf("forceoff did not send the stop code: %v", calls)
+	}
+	if mustState(t, ctx).Running {
+		t.Error("forceoff left the state running")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	events := make(chan string, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		events <- string(b)
+	}))
+	defer hook.Close()
+	trigger := filepath.Join(t.TempDir(), "panic")
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.WebhookURL = hook.URL
+		c.PanicFile = trigger
+	})
+	saveState(t, ctx, newTestState())
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event != want {
+				t.Errorf("unexpected payload: %s", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not called")
+		}
+	}
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	expect(`{"running":true,"opmode":"cool","source":"web"}`)
+	if err := os.WriteFile(trigger, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.checkPanic(mustState(t, ctx)); err != nil {
+		t.Fatal(err)
+	}
+	expect(`{"running":false,"opmode":"cool","source":"schedule"}`)
+}
+
+func TestIRRepeat(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.IRRepeat = 3
+	})
+	saveState(t, ctx, newTestState())
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	if calls := sent(t, ctx); len(calls) != 1 || !strings.Contains(calls[0], "--count=3 SEND_ONCE testac coolSTART") {
+		t.Errorf("repeat count not passed: %v", calls)
+	}
+	args := ctx.cfg.irsendArgs("SEND_START", "testac", "coolSTART")
+	if strings.Contains(strings.Join(args, " "), "--count") {
+		t.Errorf("repeat count passed to another verb: %v", args)
+	}
+	ctx.cfg.IRRepeat = 1
+	args = ctx.cfg.irsendArgs(defaultVerb, "testac", "coolSTART")
+	if strings.Contains(strings.Join(args, " "), "--count") {
+		t.Errorf("repeat count passed for a single send: %v", args)
+	}
+}
+
+func TestStartStopVerbs(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.LIRC.SendVerb = "SEND_MACRO"
+		c.LIRC.StartVerb = "SEND_START"
+		c.LIRC.StopVerb = "SEND_STOP"
+	})
+	saveState(t, ctx, newTestState())
+	serve(ctx, http.MethodPost, "/wit/on", url.Values{})
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	calls := sent(t, ctx)
+	if len(calls) != 2 || !strings.HasSuffix(calls[0], "SEND_START testac coolSTART") || !strings.HasSuffix(calls[1], "SEND_STOP testac coolSTOP") {
+		t.Errorf("start/stop verbs not used: %v", calls)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	if err := ctx.cfg.Validate(); err != nil {
+		t.Fatalf("valid configuration rejected: %v", err)
+	}
+	err := Configuration{Latitude: 91, Longitude: -181}.Validate()
+	if err == nil {
+		t.Fatal("empty configuration accepted")
+	}
+	for _, problem := range []string{"binding is not set", "cache is not set", "lirc socket is not set", "lirc irsend is not set", "lirc config is not set", "latitude is out of range: 91", "longitude is out of range: -181"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("missing %q in: %v", problem, err)
+		}
+	}
+	cfg := ctx.cfg
+	cfg.LIRC.Config = filepath.Join(t.TempDir(), "missing.conf")
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "lirc config does not exist") {
+		t.Errorf("missing lirc config not reported: %v", err)
+	}
+	cfg = ctx.cfg
+	cfg.LogLevel = "loud"
+	cfg.Timezone = "Nowhere/Special"
+	cfg.Baseline = "sometimes"
+	cfg.DefaultAction = onAction
+	cfg.PollInterval = -1
+	cfg.Labels = "maybe"
+	cfg.TLSCert = "cert.pem"
+	cfg.LIRC.SendVerb = "SHOUT"
+	err = cfg.Validate()
+	for _, problem := range []string{"invalid log level: loud", "invalid timezone", "invalid baseline: sometimes", "invalid default action: not a read action: on", "poll interval must be positive", "unknown labels", "both tlscert and tlskey must be set", "invalid irsend verb: SHOUT"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("missing %q in: %v", problem, err)
+		}
+	}
+	cfg = ctx.cfg
+	cfg.Cache = filepath.Join(t.TempDir(), "cache")
+	if err := os.WriteFile(cfg.Cache, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "directory is not writable") {
+		t.Errorf("cache that is a file not reported: %v", err)
+	}
+	if os.Geteuid() != 0 {
+		cfg.Cache = t.TempDir()
+		if err := os.Chmod(cfg.Cache, 0555); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "directory is not writable") {
+			t.Errorf("read-only cache not reported: %v", err)
+		}
+	}
+	cfg = ctx.cfg
+	cfg.Remotes = map[string]LIRCConfiguration{"bedroom": {Config: cfg.LIRC.Config}}
+	err = cfg.Validate()
+	for _, problem := range []string{"remote bedroom lirc socket is not set", "remote bedroom lirc irsend is not set"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("missing %q in: %v", problem, err)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	w := serve(ctx, http.MethodGet, "/wit/healthz", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("healthy: %d %q", w.Code, w.Body.String())
+	}
+	if err := os.RemoveAll(ctx.cfg.Cache); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(ctx, http.MethodGet, "/wit/healthz", nil)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "unhealthy") {
+		t.Errorf("unhealthy: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestActionStatusCodes(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	if w := serve(ctx, http.MethodGet, "/wit/display", nil); w.Code != http.StatusOK {
+		t.Errorf("display: %d", w.Code)
+	}
+	for _, form := range []url.Values{
+		{"opmode": {"cool"}, "sched": {"0 25 everyday on"}},
+		{"opmode": {"cool"}, "sched": {"0 7 someday on"}},
+		{"opmode": {"turbo"}, "sched": {"0 7 everyday on"}},
+	} {
+		if w := serve(ctx, http.MethodPost, "/wit/schedule", form); w.Code != http.StatusBadRequest {
+			t.Errorf("bad schedule %v: %d", form, w.Code)
+		}
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/setmode", url.Values{"mode": {"turbo"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad mode: %d", w.Code)
+	}
+	if state := mustState(t, ctx); state.Schedule != "" || state.OpMode != "cool" {
+		t.Errorf("rejected input was saved: %+v", state)
+	}
+	for _, target := range []string{"/wit/display?day=someday", "/wit/schedule.json?day=someday", "/wit/history?lines=zero", "/wit/history?lines=-1"} {
+		if w := serve(ctx, http.MethodGet, target, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("bad read %s: %d", target, w.Code)
+		}
+	}
+	if err := os.WriteFile(ctx.stateFile, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/wit/display", "/wit/status", "/wit/schedule.json", "/wit/current", "/wit/metrics"} {
+		if w := serve(ctx, http.MethodGet, target, nil); w.Code != http.StatusInternalServerError {
+			t.Errorf("unreadable state %s: %d", target, w.Code)
+		}
+	}
+}
+
+func TestUnknownAction(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		if w := serve(ctx, method, "/wit/bogus", url.Values{}); w.Code != http.StatusNotFound {
+			t.Errorf("%s bogus: %d", method, w.Code)
+		}
+	}
+	if len(sent(t, ctx)) != 0 {
+		t.Error("unknown action sent a code")
+	}
+	if err := act("bogus", true, nil, ctx); err == nil || !strings.Contains(err.Error(), "action is not handled: bogus") {
+		t.Errorf("unhandled action: %v", err)
+	}
+}
+
+func TestScheduleConflicts(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	now := time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)
+	for _, schedule := range []string{
+		"0 7 everyday on\n0 7 everyday off",
+		"0 7 weekday on\n0 7 wed off",
+		"07:00-22:00 everyday on\n0 22 everyday on",
+		"0 7 everyday on cool\n0 7 everyday on dry",
+	} {
+		if _, err := ctx.parseSchedule(schedule); err == nil || !strings.Contains(err.Error(), "conflicting schedule entries at") {
+			t.Errorf("%q: conflict not reported: %v", schedule, err)
+		}
+	}
+	for _, schedule := range []string{
+		"0 7 everyday on\n0 7 everyday on",
+		"0 7 weekday on\n0 7 weekend off",
+		"0 7 everyday on\n1 7 everyday off",
+	} {
+		if _, err := ctx.parseSchedule(schedule); err != nil {
+			t.Errorf("%q: %v", schedule, err)
+		}
+	}
+	// a conflicting schedule stored before they were refused still resolves, warning only once
+	var action string
+	var err error
+	output := captureLogs(t, levelWarn, func() {
+		for idx := 0; idx < 3; idx++ {
+			action, err = ctx.parseScheduleAt("0 7 everyday on\n0 7 everyday off", now)
+		}
+	})
+	if err != nil || action != offAction {
+		t.Errorf("stored conflict did not resolve to the later entry: %s %v", action, err)
+	}
+	if strings.Count(output, "conflicting entries") != 1 {
+		t.Errorf("stored conflict not warned once: %s", output)
+	}
+	w := serve(ctx, http.MethodPost, "/wit/schedule", url.Values{"sched": {"0 7 everyday on\n0 7 everyday off"}})
+	if w.Code != http.StatusBadRequest || mustState(t, ctx).Schedule != "" {
+		t.Errorf("conflicting schedule saved: %d", w.Code)
+	}
+}
+
+func TestSunTimes(t *testing.T) {
+	near := func(got time.Time, want time.Time) bool {
+		diff := got.Sub(want)
+		return diff > -2*time.Minute && diff < 2*time.Minute
+	}
+	rise, set, ok := sunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), 51.5074, -0.1278)
+	if !ok || !near(rise, time.Date(2024, 6, 21, 3, 43, 0, 0, time.UTC)) || !near(set, time.Date(2024, 6, 21, 20, 21, 0, 0, time.UTC)) {
+		t.Errorf("london midsummer: %v %v %v", rise.UTC(), set.UTC(), ok)
+	}
+	rise, set, ok = sunTimes(time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC), 40.7128, -74.0060)
+	if !ok || !near(rise, time.Date(2024, 12, 21, 12, 16, 0, 0, time.UTC)) || !near(set, time.Date(2024, 12, 21, 21, 31, 0, 0, time.UTC)) {
+		t.Errorf("new york midwinter: %v %v %v", rise.UTC(), set.UTC(), ok)
+	}
+	if _, _, ok := sunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), 80, 0); ok {
+		t.Error("midnight sun has a sunset")
+	}
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.Latitude = 51.5074
+		c.Longitude = -0.1278
+	})
+	ctx.cfg.location = time.FixedZone("BST", 3600)
+	schedule := "@default off\nsunrise everyday on\nsunrise+1h everyday off\nsunset-30m everyday on"
+	for clock, want := range map[string]string{"04:40": offAction, "04:46": onAction, "05:45": offAction, "20:49": offAction, "20:53": onAction} {
+		at, err := time.ParseInLocation("2006-01-02 15:04", "2024-06-21 "+clock, ctx.cfg.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action, err := ctx.parseScheduleAt(schedule, at)
+		if err != nil || action != want {
+			t.Errorf("%s: got %q (%v), want %q", clock, action, err, want)
+		}
+	}
+	ctx.cfg.Latitude, ctx.cfg.Longitude = 0, 0
+	if _, err := ctx.parseScheduleAt(schedule, time.Now()); err == nil {
+		t.Error("sun times resolved without coordinates")
+	}
+}
+
+func TestPreview(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	schedule := "0 7 everyday on\n0 22 everyday off"
+	preview, err := ctx.preview(schedule, time.Date(2024, 1, 3, 6, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Action != offAction || preview.Line != "baseline" || !preview.HasNext || preview.NextAction != onAction || preview.NextLine != "0 7 everyday on" || !preview.NextTime.Equal(time.Date(2024, 1, 3, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("before on: %+v", preview)
+	}
+	preview, err = ctx.preview(schedule, time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Action != onAction || preview.Line != "0 7 everyday on" || !preview.HasNext || preview.NextAction != offAction || !preview.NextTime.Equal(time.Date(2024, 1, 3, 22, 0, 0, 0, time.UTC)) {
+		t.Errorf("midday: %+v", preview)
+	}
+	w := serve(ctx, http.MethodGet, "/wit/preview?sched="+url.QueryEscape(schedule), nil)
+	var keys map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body.String(), err)
+	}
+	for _, key := range []string{"action", "mode", "line", "hasNext", "nextTime", "nextAction", "nextMode", "nextLine"} {
+		if _, ok := keys[key]; !ok {
+			t.Errorf("preview is missing %q: %s", key, w.Body.String())
+		}
+	}
+	if w := serve(ctx, http.MethodGet, "/wit/preview?sched="+url.QueryEscape("0 25 everyday on"), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("bad preview: %d", w.Code)
+	}
+}
+
+func TestCustomEndpoint(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.Endpoint = "ac"
+	})
+	saveState(t, ctx, newTestState())
+	mux := newTestServer(t, ctx.cfg)
+	request := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	w := request(http.MethodPost, "/ac/on")
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || location != "/ac/display" {
+		t.Errorf("redirect: %d %q", w.Code, location)
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("on not routed under the custom endpoint")
+	}
+	if w := request(http.MethodGet, "/ac/display"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/ac/") {
+		t.Errorf("display: %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/wit/off"); w.Code != http.StatusNotFound {
+		t.Errorf("default endpoint still routed: %d", w.Code)
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("off routed under the default endpoint")
+	}
+}
+
+func TestActionPaths(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	saveState(t, ctx, newTestState())
+	for _, target := range []string{"/wit/current", "/wit/current?foo=1", "/wit/current/", "/wit/current/?foo=1&bar=2"} {
+		if w := serve(ctx, http.MethodGet, target, nil); w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "NO") {
+			t.Errorf("%s: %d %q", target, w.Code, w.Body.String())
+		}
+	}
+	for _, target := range []string{"/wit/status?foo=1", "/wit/status/", "/wit/override/status/?foo=1"} {
+		w := serve(ctx, http.MethodGet, target, nil)
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+			t.Errorf("%s: %d %v", target, w.Code, err)
+		}
+	}
+	w := serve(ctx, http.MethodPost, "/wit/on/?source=test", url.Values{})
+	if w.Code != http.StatusSeeOther || !mustState(t, ctx).Running {
+		t.Errorf("on with a query and trailing slash: %d", w.Code)
+	}
+}
+
+func TestOverrideExpiry(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.OverrideTimeout = 7200
+	})
+	state := newTestState()
+	state.Schedule = "0 0 everyday on"
+	state.ScheduleEnabled = true
+	saveState(t, ctx, state)
+	start := time.Now()
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	state = mustState(t, ctx)
+	if !state.Override || state.OverrideUntil.Before(start.Add(2*time.Hour)) || state.OverrideUntil.After(time.Now().Add(2*time.Hour)) {
+		t.Fatalf("override not set for the timeout: %+v", state)
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mustState(t, ctx).Running {
+		t.Fatal("schedule ran during the override")
+	}
+	before := start.Add(time.Hour)
+	if _, err := ctx.maintain(before, before, false); err != nil {
+		t.Fatal(err)
+	}
+	if !mustState(t, ctx).Override {
+		t.Fatal("override cleared before it expired")
+	}
+	after := time.Now().Add(2*time.Hour + time.Minute)
+	if _, err := ctx.maintain(after, after, false); err != nil {
+		t.Fatal(err)
+	}
+	state = mustState(t, ctx)
+	if state.Override || !state.OverrideUntil.IsZero() {
+		t.Fatalf("expired override not cleared: %+v", state)
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("schedule did not resume after the override expired")
+	}
+}
+
+func TestOverrideMidnightInLocation(t *testing.T) {
+	location, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.location = location
+	})
+	// 20:00 UTC is 05:00 the next day in Tokyo
+	now := time.Date(2024, time.January, 3, 20, 0, 0, 0, time.UTC)
+	status := ctx.overrideStatus(&State{Override: true}, now)
+	if want := time.Date(2024, time.January, 5, 0, 0, 0, 0, location); status.ExpiresAt == nil || !status.ExpiresAt.Equal(want) {
+		t.Errorf("override expires %v, want %s", status.ExpiresAt, want)
+	}
+	saveState(t, ctx, &State{OpMode: "cool", Override: true, ScheduleEnabled: true})
+	// the UTC day changes but it is still the same day in Tokyo
+	if _, err := ctx.maintain(time.Date(2024, time.January, 4, 0, 0, 5, 0, time.UTC), time.Date(2024, time.January, 3, 23, 59, 55, 0, time.UTC), false); err != nil {
+		t.Fatal(err)
+	}
+	if !mustState(t, ctx).Override {
+		t.Error("override cleared at midnight UTC")
+	}
+	if _, err := ctx.maintain(time.Date(2024, time.January, 4, 15, 0, 5, 0, time.UTC), time.Date(2024, time.January, 4, 14, 59, 55, 0, time.UTC), false); err != nil {
+		t.Fatal(err)
+	}
+	if mustState(t, ctx).Override {
+		t.Error("override not cleared at midnight in the configured location")
+	}
+}
+
+func TestPublishPipe(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.Pipe = filepath.Join(c.Cache, "state.pipe")
+	})
+	reader, err := os.OpenFile(ctx.cfg.Pipe, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	state := newState()
+	state.Running = true
+	saveState(t, ctx, state)
+	reader.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "YES (") {
+		t.Errorf("unexpected pipe line: %q", line)
+	}
+}
+
+func TestPublishPipeFull(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.Pipe = filepath.Join(c.Cache, "state.pipe")
+	})
+	reader, err := os.OpenFile(ctx.cfg.Pipe, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	filler, err := os.OpenFile(ctx.cfg.Pipe, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filler.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		if _, err := filler.Write(make([]byte, 4096)); err != nil {
+			break
+		}
+	}
+	filler.Close()
+	state := newState()
+	state.Running = true
+	start := time.Now()
+	saveState(t, ctx, state)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("state save blocked on a full pipe for %s", elapsed)
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("state was not saved")
+	}
+}
+
+func TestPublishWithoutReader(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.Pipe = filepath.Join(c.Cache, "state.pipe")
+	})
+	saveState(t, ctx, newState())
+	w := serve(ctx, http.MethodGet, "/wit/current", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestManualGrace(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.ManualGrace = 600
+	})
+	state := newTestState()
+	state.Schedule = "0 0 everyday on"
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !mustState(t, ctx).Running {
+		t.Fatal("schedule did not turn on")
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/off", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	state = mustState(t, ctx)
+	if state.Running || state.Override {
+		t.Fatalf("manual off not applied without an override: running %t, override %t", state.Running, state.Override)
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if trace := ctx.trace.get(); trace.Reason != "manual grace" {
+		t.Errorf("schedule not suppressed by the grace window: %+v", trace)
+	}
+	if mustState(t, ctx).Running {
+		t.Fatal("manual off was not respected")
+	}
+	state = mustState(t, ctx)
+	state.LastManual = time.Now().Add(-time.Hour)
+	saveState(t, ctx, state)
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !mustState(t, ctx).Running {
+		t.Error("schedule did not resume after the grace window")
+	}
+	if calls := sent(t, ctx); len(calls) != 3 {
+		t.Errorf("unexpected irsend calls: %v", calls)
+	}
+}
+
+func TestManualWithoutGraceOverrides(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Schedule = "0 0 everyday on"
+	saveState(t, ctx, state)
+	serve(ctx, http.MethodPost, "/wit/off", url.Values{})
+	if !mustState(t, ctx).Override {
+		t.Error("web off without a grace window did not override")
+	}
+}
+
+func TestMaintainHoldsActionLock(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	state := newTestState()
+	state.Override = true
+	state.OverrideUntil = time.Now().Add(-time.Minute)
+	saveState(t, ctx, state)
+	actionLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := ctx.maintain(time.Now(), time.Now(), false); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+		t.Error("scheduler wrote the state while an action held the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	actionLock.Unlock()
+	<-done
+	if mustState(t, ctx).Override {
+		t.Error("expired override was not cleared")
+	}
+}
+
+func TestPersistOverride(t *testing.T) {
+	before := time.Date(2024, time.January, 3, 23, 59, 58, 0, time.UTC)
+	after := before.Add(5 * time.Second)
+	for _, persist := range []bool{false, true} {
+		ctx := newTestContext(t, func(c *Configuration) {
+			c.PersistOverride = persist
+		})
+		state := newTestState()
+		state.Override = true
+		saveState(t, ctx, state)
+		if _, err := ctx.maintain(before.Add(-5*time.Second), before, false); err != nil {
+			t.Fatal(err)
+		}
+		if !mustState(t, ctx).Override {
+			t.Fatal("override cleared before midnight")
+		}
+		if _, err := ctx.maintain(after, before, false); err != nil {
+			t.Fatal(err)
+		}
+		if override := mustState(t, ctx).Override; override != persist {
+			t.Errorf("override %t after midnight with persist %t", override, persist)
+		}
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	ctx := newTestContext(t, func(c *Configuration) {
+		c.Cooldown = 600
+	})
+	saveState(t, ctx, newTestState())
+	// a calibrate only syncs the tracked state, it sends nothing
+	if w := serve(ctx, http.MethodPost, "/wit/calibrate", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected calibrate status: %d", w.Code)
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/off", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Fatalf("off after a calibrate was held by the cooldown: %d", w.Code)
+	}
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("on within the cooldown was not refused: %d", w.Code)
+	}
+	if err := doScheduled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	state := mustState(t, ctx)
+	if state.Running {
+		t.Error("state changed during the cooldown")
+	}
+	if calls := sent(t, ctx); len(calls) != 1 {
+		t.Errorf("unexpected irsend calls: %v", calls)
+	}
+	state.LastChanged = time.Now().Add(-time.Hour)
+	saveState(t, ctx, state)
+	if w := serve(ctx, http.MethodPost, "/wit/on", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Errorf("on after the cooldown failed: %d", w.Code)
+	}
+}